@@ -1,6 +1,10 @@
 package config
 
 import (
+	"strings"
+	"time"
+
+	"github.com/parmus/registryindexer/pkg/index"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 )
@@ -9,6 +13,7 @@ type Config struct {
 	Registries      []*RegistryOpts     `yaml:"registries"`
 	WebhookListener WebhookListenerOpts `yaml:"webhook-listener"`
 	PubSubListener  PubSubListenerOpts  `yaml:"pubsub-listener"`
+	PollingListener PollingListenerOpts `yaml:"polling-listener"`
 	Indexer         IndexerOpts         `yaml:"indexer"`
 	API             APIOpts             `yaml:"api"`
 }
@@ -18,12 +23,14 @@ func (c *Config) UnmarshalYAML(value *yaml.Node) error {
 		Registries      []*RegistryOpts      `yaml:"registries"`
 		WebhookListener *WebhookListenerOpts `yaml:"webhook-listener"`
 		PubSubListener  *PubSubListenerOpts  `yaml:"pubsub-listener"`
+		PollingListener *PollingListenerOpts `yaml:"polling-listener"`
 		Indexer         *IndexerOpts         `yaml:"indexer"`
 		API             *APIOpts             `yaml:"api"`
 	}{
 		Registries:      c.Registries,
 		WebhookListener: &c.WebhookListener,
 		PubSubListener:  &c.PubSubListener,
+		PollingListener: &c.PollingListener,
 		Indexer:         &c.Indexer,
 		API:             &c.API,
 	}
@@ -42,12 +49,25 @@ func (c *Config) UnmarshalYAML(value *yaml.Node) error {
 	c.Registries = in.Registries
 
 	if in.WebhookListener != nil {
+		for _, registry := range in.WebhookListener.registries() {
+			if !c.hasRegistry(registry) {
+				return errors.Errorf("webhook-listener registry %s is not a configured registry", registry)
+			}
+		}
 		c.WebhookListener = *in.WebhookListener
 	}
 
 	if in.PubSubListener != nil {
 		c.PubSubListener = *in.PubSubListener
 	}
+	if in.PollingListener != nil {
+		for _, target := range in.PollingListener.Targets {
+			if !c.hasRegistry(target.domain()) {
+				return errors.Errorf("polling-listener target %s is not in a configured registry", target.name())
+			}
+		}
+		c.PollingListener = *in.PollingListener
+	}
 	if in.Indexer != nil {
 		c.Indexer = *in.Indexer
 	}
@@ -57,6 +77,25 @@ func (c *Config) UnmarshalYAML(value *yaml.Node) error {
 	return nil
 }
 
+// hasRegistry reports whether a registry domain is configured
+func (c *Config) hasRegistry(domain string) bool {
+	for _, registry := range c.Registries {
+		if strings.EqualFold(registry.Domain(), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// RegistryDomains returns the domains of the configured registries
+func (c *Config) RegistryDomains() []string {
+	domains := make([]string, len(c.Registries))
+	for i, registry := range c.Registries {
+		domains[i] = registry.Domain()
+	}
+	return domains
+}
+
 type APIOpts struct {
 	Listen       string `yaml:"listen"`
 	CORSAllowAll bool   `yaml:"cors-allow-all"`
@@ -88,10 +127,23 @@ func DefaultConfig() *Config {
 			Prefixes:     make([]string, 0),
 			Subscription: "registryindexer",
 		},
+		PollingListener: PollingListenerOpts{
+			Interval: 15 * time.Minute,
+			Jitter:   0.1,
+		},
 		Indexer: IndexerOpts{
-			QueueLength:    1024,
-			StateFile:      "",
-			IndexOnStartup: true,
+			QueueLength:        1024,
+			StateFile:          "",
+			StateCompression:   string(index.DefaultCompression),
+			IndexOnStartup:     true,
+			MaxWorkers:         index.DefaultMaxWorkers,
+			WorkersPerRegistry: index.DefaultWorkersPerRegistry,
+			SnapshotInterval:   index.DefaultSnapshotInterval,
+			SnapshotMutations:  index.DefaultSnapshotMutations,
+			Backend: BackendOpts{
+				Type:      "memory",
+				CacheSize: index.DefaultBoltCacheSize,
+			},
 		},
 		API: APIOpts{
 			Listen: ":5010",
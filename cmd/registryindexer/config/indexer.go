@@ -2,23 +2,63 @@ package config
 
 import (
 	"context"
+	"net/url"
+	"time"
 
 	"github.com/parmus/registryindexer/pkg/index"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
 	"gopkg.in/yaml.v3"
 )
 
 type IndexerOpts struct {
-	QueueLength    uint64 `yaml:"queue-length"`
-	StateFile      string `yaml:"state-file"`
-	IndexOnStartup bool   `yaml:"index-on-startup"`
+	QueueLength        uint64         `yaml:"queue-length"`
+	StateFile          string         `yaml:"state-file"`
+	StateCompression   string         `yaml:"state-compression"`
+	IndexOnStartup     bool           `yaml:"index-on-startup"`
+	MaxWorkers         int            `yaml:"max-workers"`
+	WorkersPerRegistry int            `yaml:"workers-per-registry"`
+	Reconcile          *ReconcileOpts `yaml:"reconcile,omitempty"`
+	SnapshotInterval   time.Duration  `yaml:"snapshot-interval"`
+	SnapshotMutations  uint64         `yaml:"snapshot-mutations"`
+	Backend            BackendOpts    `yaml:"backend"`
+}
+
+// BackendOpts selects where the index is kept. The memory backend keeps the
+// index in memory and saves it to the state file, the bolt backend keeps it
+// on disk in a bbolt database and only caches cache-size repositories in
+// memory, and the sqlite backend keeps it in a SQLite database. The backend
+// can also be given as a URI like sqlite:///path/to/index.db.
+type BackendOpts struct {
+	Type      string `yaml:"type"`
+	Path      string `yaml:"path,omitempty"`
+	CacheSize int    `yaml:"cache-size"`
+}
+
+// ReconcileOpts schedules periodic reconciliations of the index with the
+// registries, either by a cron expression or by a fixed interval
+type ReconcileOpts struct {
+	Schedule    string        `yaml:"schedule,omitempty"`
+	Interval    time.Duration `yaml:"interval,omitempty"`
+	PerRegistry bool          `yaml:"per-registry,omitempty"`
+
+	schedule cron.Schedule
 }
 
 func (i *IndexerOpts) UnmarshalYAML(value *yaml.Node) error {
 	var in struct {
-		QueueLength    *uint64 `yaml:"queue-length,omitempty"`
-		StateFile      *string `yaml:"state-file"`
-		IndexOnStartup *bool   `yaml:"index-on-startup"`
+		QueueLength        *uint64        `yaml:"queue-length,omitempty"`
+		StateFile          *string        `yaml:"state-file"`
+		StateCompression   *string        `yaml:"state-compression"`
+		IndexOnStartup     *bool          `yaml:"index-on-startup"`
+		MaxWorkers         *int           `yaml:"max-workers"`
+		WorkersPerRegistry *int           `yaml:"workers-per-registry"`
+		Reconcile          *ReconcileOpts `yaml:"reconcile"`
+		SnapshotInterval   *time.Duration `yaml:"snapshot-interval"`
+		SnapshotMutations  *uint64        `yaml:"snapshot-mutations"`
+		Backend            *BackendOpts   `yaml:"backend"`
 	}
+	in.Backend = &i.Backend
 
 	if err := value.Decode(&in); err != nil {
 		return err
@@ -29,12 +69,151 @@ func (i *IndexerOpts) UnmarshalYAML(value *yaml.Node) error {
 	if in.StateFile != nil {
 		i.StateFile = *in.StateFile
 	}
+	if in.StateCompression != nil {
+		if _, err := index.ParseCompression(*in.StateCompression); err != nil {
+			return err
+		}
+		i.StateCompression = *in.StateCompression
+	}
 	if in.IndexOnStartup != nil {
 		i.IndexOnStartup = *in.IndexOnStartup
 	}
+	if in.MaxWorkers != nil {
+		i.MaxWorkers = *in.MaxWorkers
+	}
+	if in.WorkersPerRegistry != nil {
+		i.WorkersPerRegistry = *in.WorkersPerRegistry
+	}
+	if in.Reconcile != nil {
+		i.Reconcile = in.Reconcile
+	}
+	if in.SnapshotInterval != nil {
+		i.SnapshotInterval = *in.SnapshotInterval
+	}
+	if in.SnapshotMutations != nil {
+		i.SnapshotMutations = *in.SnapshotMutations
+	}
 	return nil
 }
 
+func (b *BackendOpts) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		uri, err := url.Parse(value.Value)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid index backend %q", value.Value)
+		}
+		if uri.Scheme == "" {
+			b.Type, b.Path = value.Value, ""
+		} else {
+			b.Type, b.Path = uri.Scheme, uri.Host+uri.Path
+		}
+		return b.validate()
+	}
+
+	var in struct {
+		Type      *string `yaml:"type"`
+		Path      *string `yaml:"path"`
+		CacheSize *int    `yaml:"cache-size"`
+	}
+
+	if err := value.Decode(&in); err != nil {
+		return err
+	}
+	if in.Type != nil {
+		b.Type = *in.Type
+	}
+	if in.Path != nil {
+		b.Path = *in.Path
+	}
+	if in.CacheSize != nil {
+		b.CacheSize = *in.CacheSize
+	}
+	return b.validate()
+}
+
+func (b *BackendOpts) validate() error {
+	switch b.Type {
+	case "memory":
+	case "bolt", "sqlite":
+		if b.Path == "" {
+			return errors.Errorf("The %s backend requires a path", b.Type)
+		}
+	default:
+		return errors.Errorf("Unknown index backend %q", b.Type)
+	}
+	return nil
+}
+
+func (r *ReconcileOpts) UnmarshalYAML(value *yaml.Node) error {
+	var in struct {
+		Schedule    string        `yaml:"schedule"`
+		Interval    time.Duration `yaml:"interval"`
+		PerRegistry bool          `yaml:"per-registry"`
+	}
+
+	if err := value.Decode(&in); err != nil {
+		return err
+	}
+
+	switch {
+	case in.Schedule != "" && in.Interval != 0:
+		return errors.New("Reconcile takes either a schedule or an interval, not both")
+	case in.Schedule != "":
+		schedule, err := cron.ParseStandard(in.Schedule)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid reconcile schedule %q", in.Schedule)
+		}
+		r.schedule = schedule
+	case in.Interval > 0:
+		r.schedule = cron.Every(in.Interval)
+	default:
+		return errors.New("Reconcile requires a schedule or a positive interval")
+	}
+
+	r.Schedule = in.Schedule
+	r.Interval = in.Interval
+	r.PerRegistry = in.PerRegistry
+	return nil
+}
+
+// Enabled returns true if periodic reconciliations are scheduled
+func (r *ReconcileOpts) Enabled() bool {
+	return r != nil && r.schedule != nil
+}
+
+// GetSchedule returns the schedule of reconciliations
+func (r *ReconcileOpts) GetSchedule() cron.Schedule {
+	return r.schedule
+}
+
 func (i *IndexerOpts) GetStateStorage(ctx context.Context) (index.StateStorage, error) {
-	return index.NewStateStorage(i.StateFile, ctx)
+	compression, err := index.ParseCompression(i.StateCompression)
+	if err != nil {
+		return nil, err
+	}
+	return index.NewStateStorage(i.StateFile, compression, ctx)
+}
+
+// GetBackend opens the configured index backend. The memory backend is
+// loaded from the state storage.
+func (i *IndexerOpts) GetBackend(storage index.StateStorage) (index.Backend, error) {
+	switch i.Backend.Type {
+	case "bolt":
+		return index.OpenBoltBackend(i.Backend.Path, i.Backend.CacheSize)
+	case "sqlite":
+		return index.OpenSQLiteBackend(i.Backend.Path)
+	}
+	idx, err := storage.LoadIndex()
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (i *IndexerOpts) GetSnapshotter(storage index.StateStorage, idx index.Backend, cache *index.ConfigCache) *index.Snapshotter {
+	return index.NewSnapshotter(storage, idx, cache, i.SnapshotInterval, i.SnapshotMutations)
+}
+
+func (i *IndexerOpts) GetWorkerPool() *index.WorkerPool {
+	return index.NewWorkerPool(i.MaxWorkers, i.WorkersPerRegistry)
 }
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/parmus/registryindexer/internal/notifications"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// PollingListenerOpts configures polling of repositories in registries, which
+// can't send notifications
+type PollingListenerOpts struct {
+	Interval time.Duration     `yaml:"interval"`
+	Jitter   float64           `yaml:"jitter"`
+	Targets  []*PollTargetOpts `yaml:"targets,omitempty"`
+}
+
+// PollTargetOpts configures polling of a repository, or of the repositories
+// with a name prefix, on an interval. Targets without an interval are polled
+// on the interval of the listener.
+type PollTargetOpts struct {
+	Repository string        `yaml:"repository,omitempty"`
+	Prefix     string        `yaml:"prefix,omitempty"`
+	Interval   time.Duration `yaml:"interval,omitempty"`
+
+	repositoryRef reference.Named
+}
+
+func (p *PollingListenerOpts) UnmarshalYAML(value *yaml.Node) error {
+	var in struct {
+		Interval *time.Duration
+		Jitter   *float64
+		Targets  []*PollTargetOpts
+	}
+
+	if err := value.Decode(&in); err != nil {
+		return err
+	}
+	if in.Interval != nil {
+		if *in.Interval <= 0 {
+			return errors.New("polling-listener interval must be positive")
+		}
+		p.Interval = *in.Interval
+	}
+	if in.Jitter != nil {
+		if *in.Jitter < 0 || *in.Jitter >= 1 {
+			return errors.Errorf("polling-listener jitter %v must be at least 0 and less than 1", *in.Jitter)
+		}
+		p.Jitter = *in.Jitter
+	}
+	for _, target := range in.Targets {
+		if err := target.validate(); err != nil {
+			return err
+		}
+	}
+	p.Targets = in.Targets
+	return nil
+}
+
+func (t *PollTargetOpts) validate() error {
+	if (t.Repository == "") == (t.Prefix == "") {
+		return errors.New("polling-listener target must have either a repository or a prefix")
+	}
+	if t.Interval < 0 {
+		return errors.Errorf("polling-listener target %s has a negative interval", t.name())
+	}
+	if t.Repository != "" {
+		repositoryRef, err := reference.ParseNamed(t.Repository)
+		if err != nil {
+			return errors.Wrapf(err, "polling-listener target has invalid repository %q", t.Repository)
+		}
+		if _, ok := repositoryRef.(reference.Tagged); ok {
+			return errors.Errorf("polling-listener target repository %q must not have a tag", t.Repository)
+		}
+		t.repositoryRef = reference.TrimNamed(repositoryRef)
+	}
+	return nil
+}
+
+// name returns the repository or prefix of a target
+func (t *PollTargetOpts) name() string {
+	if t.Repository != "" {
+		return t.Repository
+	}
+	return t.Prefix
+}
+
+// domain returns the registry domain of a target
+func (t *PollTargetOpts) domain() string {
+	return strings.SplitN(t.name(), "/", 2)[0]
+}
+
+func (p *PollingListenerOpts) Enabled() bool {
+	return len(p.Targets) > 0
+}
+
+// GetTargets returns the targets to poll
+func (p *PollingListenerOpts) GetTargets() []notifications.PollTarget {
+	targets := make([]notifications.PollTarget, len(p.Targets))
+	for i, target := range p.Targets {
+		targets[i] = notifications.PollTarget{
+			Repository: target.repositoryRef,
+			Prefix:     target.Prefix,
+			Interval:   target.Interval,
+		}
+		if targets[i].Interval == 0 {
+			targets[i].Interval = p.Interval
+		}
+	}
+	return targets
+}
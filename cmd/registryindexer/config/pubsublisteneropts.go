@@ -5,20 +5,23 @@ import (
 )
 
 type PubSubListenerOpts struct {
-	Projects     []string
-	Prefixes     []string
-	Subscription string
+	Projects               []string
+	Prefixes               []string
+	Subscription           string
+	DeadLetterSubscription string
 }
 
 func (p *PubSubListenerOpts) UnmarshalYAML(value *yaml.Node) error {
 	in := struct {
-		Projects     []string
-		Prefixes     []string
-		Subscription *string
+		Projects               []string
+		Prefixes               []string
+		Subscription           *string
+		DeadLetterSubscription *string `yaml:"dead-letter-subscription"`
 	}{
-		Projects:     p.Projects,
-		Prefixes:     p.Prefixes,
-		Subscription: &p.Subscription,
+		Projects:               p.Projects,
+		Prefixes:               p.Prefixes,
+		Subscription:           &p.Subscription,
+		DeadLetterSubscription: &p.DeadLetterSubscription,
 	}
 
 	if err := value.Decode(&in); err != nil {
@@ -28,6 +31,9 @@ func (p *PubSubListenerOpts) UnmarshalYAML(value *yaml.Node) error {
 	if in.Subscription != nil {
 		p.Subscription = *in.Subscription
 	}
+	if in.DeadLetterSubscription != nil {
+		p.DeadLetterSubscription = *in.DeadLetterSubscription
+	}
 
 	p.Projects = in.Projects
 	p.Prefixes = in.Prefixes
@@ -4,20 +4,25 @@ import (
 	"context"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 
 	"github.com/parmus/registryindexer/pkg/auth"
+	registry_client "github.com/parmus/registryindexer/pkg/registry"
 	docker_auth "github.com/docker/distribution/registry/client/auth"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/registry"
 )
 
 type RegistryOpts struct {
-	BaseURL     *url.URL
-	Prefixes    []string
-	Credentials *Credentials
+	BaseURL        *url.URL
+	Prefixes       []string
+	Credentials    *Credentials
+	RateLimit      *RateLimitOpts
+	ConnectTimeout *time.Duration
+	RequestTimeout *time.Duration
 }
 
 type Credentials struct {
@@ -25,24 +30,40 @@ type Credentials struct {
 	Password string
 }
 
+// RateLimitOpts configures the request budget for a registry
+type RateLimitOpts struct {
+	RequestsPerSecond float64 `yaml:"requests-per-second"`
+	Burst             int     `yaml:"burst,omitempty"`
+	MaxRetries        *int    `yaml:"max-retries,omitempty"`
+}
+
 func (r *RegistryOpts) MarshalYAML() (interface{}, error) {
 	out := struct {
-		BaseURL     string
-		Prefixes    []string
-		Credentials *Credentials
+		BaseURL        string
+		Prefixes       []string
+		Credentials    *Credentials
+		RateLimit      *RateLimitOpts `yaml:"rate-limit,omitempty"`
+		ConnectTimeout *time.Duration `yaml:"connect-timeout,omitempty"`
+		RequestTimeout *time.Duration `yaml:"request-timeout,omitempty"`
 	}{
-		BaseURL:     r.BaseURL.String(),
-		Prefixes:    r.Prefixes,
-		Credentials: r.Credentials,
+		BaseURL:        r.BaseURL.String(),
+		Prefixes:       r.Prefixes,
+		Credentials:    r.Credentials,
+		RateLimit:      r.RateLimit,
+		ConnectTimeout: r.ConnectTimeout,
+		RequestTimeout: r.RequestTimeout,
 	}
 	return out, nil
 }
 
 func (c *RegistryOpts) UnmarshalYAML(value *yaml.Node) error {
 	var in struct {
-		BaseURL     string
-		Prefixes    []string
-		Credentials *Credentials
+		BaseURL        string
+		Prefixes       []string
+		Credentials    *Credentials
+		RateLimit      *RateLimitOpts `yaml:"rate-limit"`
+		ConnectTimeout *time.Duration `yaml:"connect-timeout"`
+		RequestTimeout *time.Duration `yaml:"request-timeout"`
 	}
 	var err error
 	err = value.Decode(&in)
@@ -69,10 +90,18 @@ func (c *RegistryOpts) UnmarshalYAML(value *yaml.Node) error {
 	c.BaseURL = baseurl
 	c.Prefixes = in.Prefixes
 	c.Credentials = in.Credentials
+	c.RateLimit = in.RateLimit
+	c.ConnectTimeout = in.ConnectTimeout
+	c.RequestTimeout = in.RequestTimeout
 
 	return nil
 }
 
+// Domain returns the domain of the names of repositories in the registry
+func (c *RegistryOpts) Domain() string {
+	return c.BaseURL.Host
+}
+
 func (c *RegistryOpts) GetCredentialStore(context context.Context) (docker_auth.CredentialStore, error) {
 	if c.Credentials != nil {
 		return registry.NewStaticCredentialStore(&types.AuthConfig{
@@ -83,3 +112,22 @@ func (c *RegistryOpts) GetCredentialStore(context context.Context) (docker_auth.
 
 	return auth.NewApplicationDefaultCredentialStore(context)
 }
+
+// GetOptions returns the registry client options
+func (c *RegistryOpts) GetOptions() registry_client.Options {
+	options := registry_client.DefaultOptions()
+	if c.RateLimit != nil {
+		options.RequestsPerSecond = c.RateLimit.RequestsPerSecond
+		options.Burst = c.RateLimit.Burst
+		if c.RateLimit.MaxRetries != nil {
+			options.MaxRetries = *c.RateLimit.MaxRetries
+		}
+	}
+	if c.ConnectTimeout != nil {
+		options.ConnectTimeout = *c.ConnectTimeout
+	}
+	if c.RequestTimeout != nil {
+		options.RequestTimeout = *c.RequestTimeout
+	}
+	return options
+}
@@ -1,34 +1,131 @@
 package config
 
 import (
+	"strings"
+
+	"github.com/parmus/registryindexer/internal/notifications"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 )
 
 type WebhookListenerOpts struct {
-	Registry string
-	Listen   string
+	Registry       string
+	Listen         string
+	Token          string                 `yaml:"token,omitempty"`
+	HMACSecret     string                 `yaml:"hmac-secret,omitempty"`
+	AllowedIPs     []string               `yaml:"allowed-ips,omitempty"`
+	DeadLetterFile string                 `yaml:"dead-letter-file,omitempty"`
+	Endpoints      []*WebhookEndpointOpts `yaml:"endpoints,omitempty"`
+}
+
+// WebhookEndpointOpts configures an endpoint receiving webhooks in a format
+type WebhookEndpointOpts struct {
+	Path     string `yaml:"path"`
+	Format   string `yaml:"format"`
+	Registry string `yaml:"registry,omitempty"`
 }
 
+// DefaultWebhookPath is the path of the default endpoint, which receives
+// Docker Registry notifications
+const DefaultWebhookPath = "/event"
+
 func (w *WebhookListenerOpts) UnmarshalYAML(value *yaml.Node) error {
 	var in struct {
-		Registry string
-		Listen   *string
+		Registry       string
+		Listen         *string
+		Token          string
+		HMACSecret     string   `yaml:"hmac-secret"`
+		AllowedIPs     []string `yaml:"allowed-ips"`
+		DeadLetterFile string   `yaml:"dead-letter-file"`
+		Endpoints      []*WebhookEndpointOpts
 	}
 
 	if err := value.Decode(&in); err != nil {
 		return err
 	}
-	if in.Listen != nil && in.Registry == "" {
-		return errors.Errorf("webhook-listener must include registry")
+	if _, err := notifications.ParseNetworks(in.AllowedIPs); err != nil {
+		return errors.Wrap(err, "webhook-listener has invalid allowed-ips")
+	}
+	paths := make(map[string]bool)
+	for _, endpoint := range in.Endpoints {
+		if err := endpoint.validate(); err != nil {
+			return err
+		}
+		if paths[endpoint.Path] {
+			return errors.Errorf("webhook-listener has duplicate endpoint %s", endpoint.Path)
+		}
+		paths[endpoint.Path] = true
 	}
 	if in.Listen != nil {
 		w.Listen = *in.Listen
 	}
 	w.Registry = in.Registry
+	w.Token = in.Token
+	w.HMACSecret = in.HMACSecret
+	w.AllowedIPs = in.AllowedIPs
+	w.DeadLetterFile = in.DeadLetterFile
+	w.Endpoints = in.Endpoints
+	return nil
+}
+
+func (e *WebhookEndpointOpts) validate() error {
+	if !strings.HasPrefix(e.Path, "/") {
+		return errors.Errorf("webhook-listener endpoint path %q must start with /", e.Path)
+	}
+	if e.Format == "" {
+		e.Format = notifications.DistributionFormat
+	}
+	if _, err := notifications.GetParser(e.Format); err != nil {
+		return errors.Errorf("webhook-listener endpoint %s has unknown format %q (one of %s)", e.Path, e.Format, strings.Join(notifications.Formats(), ", "))
+	}
 	return nil
 }
 
 func (w *WebhookListenerOpts) Enabled() bool {
 	return w.Listen != ""
 }
+
+// GetEndpoints returns the endpoints of the listener. Docker Registry
+// notifications are received on DefaultWebhookPath, unless it's configured
+// as another endpoint.
+func (w *WebhookListenerOpts) GetEndpoints() []notifications.WebhookEndpoint {
+	var endpoints []notifications.WebhookEndpoint
+	defaultPath := true
+	for _, endpoint := range w.Endpoints {
+		endpoints = append(endpoints, notifications.WebhookEndpoint{
+			Path:     endpoint.Path,
+			Format:   endpoint.Format,
+			Registry: endpoint.Registry,
+		})
+		defaultPath = defaultPath && endpoint.Path != DefaultWebhookPath
+	}
+	if defaultPath {
+		endpoints = append(endpoints, notifications.WebhookEndpoint{
+			Path:     DefaultWebhookPath,
+			Format:   notifications.DistributionFormat,
+			Registry: w.Registry,
+		})
+	}
+	return endpoints
+}
+
+// registries returns the registries of the listener and its endpoints
+func (w *WebhookListenerOpts) registries() []string {
+	var registries []string
+	for _, endpoint := range w.GetEndpoints() {
+		if endpoint.Registry != "" {
+			registries = append(registries, endpoint.Registry)
+		}
+	}
+	return registries
+}
+
+// GetAuth returns the authentication of webhook requests
+func (w *WebhookListenerOpts) GetAuth() notifications.WebhookAuth {
+	networks, _ := notifications.ParseNetworks(w.AllowedIPs)
+	return notifications.WebhookAuth{
+		Token:           w.Token,
+		HMACSecret:      w.HMACSecret,
+		AllowedNetworks: networks,
+	}
+}
@@ -20,6 +20,17 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "import":
+			runImport(os.Args[2:])
+			return
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	wg := &sync.WaitGroup{}
 
@@ -28,10 +39,14 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error while trying to initialize cache: %v", err)
 	}
-	index, err := stateStorage.LoadIndex()
+	index, err := config.Indexer.GetBackend(stateStorage)
 	if err != nil {
 		log.Fatalf("Error while trying to read cache: %v", err)
 	}
+	configCache, err := stateStorage.LoadConfigCache()
+	if err != nil {
+		log.Fatalf("Error while trying to read config cache: %v", err)
+	}
 
 	registries := make([]*registry.Registry, len(config.Registries))
 	for i, r := range config.Registries {
@@ -40,14 +55,14 @@ func main() {
 			log.Fatal(err)
 		}
 
-		registry, err := registry.NewRegistry(r.BaseURL, r.Prefixes, 50, credentialStore)
+		registry, err := registry.NewRegistry(r.BaseURL, r.Prefixes, credentialStore, r.GetOptions())
 		if err != nil {
 			log.Fatal(err)
 		}
 		registries[i] = registry
 	}
 
-	indexer, err := indexing.NewIndexer(index, config.Indexer.QueueLength, registries...)
+	indexer, err := indexing.NewIndexer(index, configCache, config.Indexer.QueueLength, config.Indexer.GetWorkerPool(), registries...)
 	if err != nil {
 		log.Fatalf("Failed to create indexer: %+v", err)
 	}
@@ -63,22 +78,66 @@ func main() {
 		},
 	)
 
-	controller := api.NewController(index, config.API.Listen, config.API.CORSAllowAll)
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "registryindexer",
+			Name:      "retries_pending",
+			Help:      "Number of failed repositories and images waiting to be retried",
+		},
+		func() float64 {
+			return float64(indexer.RetryCount())
+		},
+	)
+
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "registryindexer",
+			Name:      "config_cache_images",
+			Help:      "Number of images in the config cache",
+		},
+		func() float64 {
+			return float64(configCache.Len())
+		},
+	)
+
+	controller := api.NewController(index, indexer, config.API.Listen, config.API.CORSAllowAll)
 	controller.Serve(ctx, wg)
 	log.Printf("Listening on %v", config.API.Listen)
 
 	if config.WebhookListener.Enabled() {
-		notifications.NewWebHookLister(indexer.ActionQueue(), config.WebhookListener.Registry, config.WebhookListener.Listen).Serve(ctx, wg)
+		if webhookListener, err := notifications.NewWebHookLister(indexer.ActionQueue(), config.WebhookListener.GetEndpoints(), config.RegistryDomains(), config.WebhookListener.Listen, config.WebhookListener.GetAuth(), config.WebhookListener.DeadLetterFile); err == nil {
+			webhookListener.Serve(ctx, wg)
+		} else {
+			log.Fatalf("Failed to create webhook listener: %+v", err)
+		}
 		log.Printf("Listening for webhook notifications on %v", config.WebhookListener.Listen)
 	}
+	if config.Indexer.Reconcile.Enabled() {
+		var domains []string
+		if config.Indexer.Reconcile.PerRegistry {
+			for _, registry := range registries {
+				domains = append(domains, registry.Domain())
+			}
+		}
+		notifications.NewScheduler(indexer.ActionQueue(), config.Indexer.Reconcile.GetSchedule(), domains...).Serve(ctx, wg)
+		log.Printf("Scheduled reconciliations")
+	}
 	if config.PubSubListener.Enabled() {
-		if pubsublistener, err := notifications.NewPubSubListener(indexer.ActionQueue(), config.PubSubListener.Projects, config.PubSubListener.Prefixes, config.PubSubListener.Subscription); err == nil {
+		if pubsublistener, err := notifications.NewPubSubListener(indexer.ActionQueue(), config.PubSubListener.Projects, config.PubSubListener.Prefixes, config.PubSubListener.Subscription, config.PubSubListener.DeadLetterSubscription, config.RegistryDomains()); err == nil {
 			pubsublistener.Serve(ctx, wg)
 		} else {
 			log.Fatalf("Failed to create PubSub listener: %+v", err)
 		}
 		log.Printf("Listening for PubSub notifications")
 	}
+	if config.PollingListener.Enabled() {
+		if poller, err := notifications.NewPoller(indexer.ActionQueue(), indexer, config.PollingListener.GetTargets(), config.PollingListener.Jitter, registries...); err == nil {
+			poller.Serve(ctx, wg)
+		} else {
+			log.Fatalf("Failed to create polling listener: %+v", err)
+		}
+		log.Printf("Polling %d targets for changed tags", len(config.PollingListener.Targets))
+	}
 
 	promauto.NewGaugeFunc(
 		prometheus.GaugeOpts{
@@ -87,28 +146,22 @@ func main() {
 			Help:      "Total number of indexed images",
 		},
 		func() float64 {
-			index.Locker().Lock()
-			defer index.Locker().Unlock()
+			repositories, err := index.Repositories()
+			if err != nil {
+				log.Printf("Unable to count images: %v", err)
+				return 0
+			}
 
 			var total int
-			for _, repository := range index.Repositories() {
-				total = total + len(index.Repository(repository).Images)
+			for _, repository := range repositories {
+				total = total + repository.Images
 			}
 			return float64(total)
 		},
 	)
 
-	if config.Indexer.IndexOnStartup {
-		start := time.Now()
-		log.Println("Reindexing started")
-		err := indexer.IndexAll()
-		if err != nil {
-			log.Fatalf("Failed to reindex registry: %v", err)
-		}
-		log.Printf("Indexed in %.2f seconds\n", time.Since(start).Seconds())
-	}
-
-	indexer.Serve(ctx, wg)
+	snapshotter := config.Indexer.GetSnapshotter(stateStorage, index, configCache)
+	snapshotter.Serve(ctx, wg)
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -118,12 +171,27 @@ func main() {
 		defer wg.Done()
 
 		<-sigs
-		if err := stateStorage.SaveIndex(index); err != nil {
+		if err := snapshotter.Snapshot(); err != nil {
 			log.Fatalf("Failed to store cached index: %v", err)
 		}
 		cancel()
 	}(cancel)
 
+	if config.Indexer.IndexOnStartup {
+		start := time.Now()
+		log.Println("Reindexing started")
+		err := indexer.IndexAll(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Fatalf("Failed to reindex registry: %v", err)
+		}
+		log.Printf("Indexed in %.2f seconds\n", time.Since(start).Seconds())
+	}
+
+	indexer.Serve(ctx, wg)
+
 	wg.Wait()
+	if err := index.Close(); err != nil {
+		log.Printf("Failed to close index: %v", err)
+	}
 	log.Printf("Shutting down")
 }
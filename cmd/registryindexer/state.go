@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	indexing "github.com/parmus/registryindexer/pkg/index"
+	"github.com/pkg/errors"
+)
+
+// stringList is a flag, which can be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// openState opens the index in a state file path or URI, or in a bolt:// or
+// sqlite:// database, and returns a function saving it
+func openState(ctx context.Context, location string, compression indexing.Compression, readOnly bool) (indexing.Backend, func() error, error) {
+	if uri, err := url.Parse(location); err == nil && (uri.Scheme == "bolt" || uri.Scheme == "sqlite") {
+		// Like the backend of the config, relative paths are in the host
+		path := uri.Host + uri.Path
+		if path == "" {
+			return nil, nil, errors.Errorf("The %s backend requires a path", uri.Scheme)
+		}
+		if uri.Scheme == "bolt" {
+			backend, err := indexing.OpenBoltBackend(path, 0)
+			if err != nil {
+				return nil, nil, err
+			}
+			return backend, backend.Close, nil
+		}
+		backend, err := indexing.OpenSQLiteBackend(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return backend, backend.Close, nil
+	}
+
+	var storage indexing.StateStorage
+	var err error
+	if readOnly {
+		storage, err = indexing.NewReadOnlyStateStorage(location, ctx)
+	} else {
+		storage, err = indexing.NewStateStorage(location, compression, ctx)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	index, err := storage.LoadIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+	return index, func() error { return storage.SaveIndex(index) }, nil
+}
+
+// stateFlags parses the flags shared by the export and import subcommands,
+// and returns the state location
+func stateFlags(flags *flag.FlagSet, args []string, format *string, filter *indexing.RepositoryFilter) string {
+	flags.StringVar(format, "format", string(indexing.ExportJSON), "Export format (json or ndjson)")
+	flags.Var((*stringList)(&filter.Registries), "registry", "Only include repositories in this registry domain (repeatable)")
+	flags.Var((*stringList)(&filter.Prefixes), "prefix", "Only include repositories with this name prefix (repeatable)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] <state-file|bolt:///path|sqlite:///path>\n", os.Args[0], flags.Name())
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	return flags.Arg(0)
+}
+
+// runExport exports the index in a state to a file or stdout
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	var format string
+	var filter indexing.RepositoryFilter
+	output := flags.String("output", "", "Write the export to this file instead of stdout")
+	location := stateFlags(flags, args, &format, &filter)
+
+	exportFormat, err := indexing.ParseExportFormat(format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	backend, _, err := openState(context.Background(), location, indexing.DefaultCompression, true)
+	if err != nil {
+		log.Fatalf("Failed to read state: %v", err)
+	}
+	defer backend.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create export: %v", err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	exported, err := indexing.Export(w, backend, exportFormat, &filter)
+	if err != nil {
+		log.Fatalf("Failed to export state: %v", err)
+	}
+	log.Printf("Exported %d images", exported)
+}
+
+// runImport imports an export from a file or stdin into the index in a
+// state. Imported repositories replace indexed repositories of the same name.
+func runImport(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	var format string
+	var filter indexing.RepositoryFilter
+	input := flags.String("input", "", "Read the export from this file instead of stdin")
+	compression := flags.String("compression", string(indexing.DefaultCompression), "Compression of a saved state file (none, gzip or zstd)")
+	location := stateFlags(flags, args, &format, &filter)
+
+	exportFormat, err := indexing.ParseExportFormat(format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stateCompression, err := indexing.ParseCompression(*compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		file, err := os.Open(*input)
+		if err != nil {
+			log.Fatalf("Failed to open export: %v", err)
+		}
+		defer file.Close()
+		r = file
+	}
+	repositories, err := indexing.Import(r, exportFormat, &filter)
+	if err != nil {
+		log.Fatalf("Failed to read export: %v", err)
+	}
+
+	backend, save, err := openState(context.Background(), location, stateCompression, false)
+	if err != nil {
+		log.Fatalf("Failed to read state: %v", err)
+	}
+	imported := 0
+	for _, repository := range repositories {
+		if err := backend.ReplaceRepository(repository); err != nil {
+			log.Fatalf("Failed to import %v: %v", repository.Name, err)
+		}
+		imported += len(repository.Images)
+	}
+	if err := save(); err != nil {
+		log.Fatalf("Failed to save state: %v", err)
+	}
+	log.Printf("Imported %d images in %d repositories", imported, len(repositories))
+}
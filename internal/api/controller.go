@@ -15,6 +15,7 @@ import (
 	"github.com/docker/distribution/reference"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -30,13 +31,13 @@ var openAPIContent embed.FS
 
 // The Controller implements the API endpoints
 type Controller struct {
-	index  *index.Index
-	locker sync.Locker
-	server *http.Server
+	index   index.Backend
+	indexer *index.Indexer
+	server  *http.Server
 }
 
 // NewController creates a new Controller instance fully ready to serve
-func NewController(index *index.Index, listen string, CORSAllowAll bool) *Controller {
+func NewController(index index.Backend, indexer *index.Indexer, listen string, CORSAllowAll bool) *Controller {
 	router := mux.NewRouter()
 
 	var handler http.Handler = router
@@ -50,8 +51,8 @@ func NewController(index *index.Index, listen string, CORSAllowAll bool) *Contro
 	}
 
 	c := &Controller{
-		index:  index,
-		locker: index.Locker(),
+		index:   index,
+		indexer: indexer,
 		server: &http.Server{
 			Addr:    listen,
 			Handler: handler,
@@ -81,6 +82,15 @@ func NewController(index *index.Index, listen string, CORSAllowAll bool) *Contro
 			http.HandlerFunc(c.getImage),
 		),
 	).Methods("GET")
+	router.Handle(
+		"/repositories/{repository:"+repositoryName+"}/digests/{digest}",
+		promhttp.InstrumentHandlerDuration(
+			requestDuration.MustCurryWith(
+				prometheus.Labels{"endpoint": "/repositories/{repository}/digests/{digest}"},
+			),
+			http.HandlerFunc(c.getImagesByDigest),
+		),
+	).Methods("GET")
 	router.Handle(
 		"/repositories/{repository:"+repositoryName+"}/tags",
 		promhttp.InstrumentHandlerDuration(
@@ -99,6 +109,15 @@ func NewController(index *index.Index, listen string, CORSAllowAll bool) *Contro
 			http.HandlerFunc(c.listRepositories),
 		),
 	).Methods("GET")
+	router.Handle(
+		"/reconciliation",
+		promhttp.InstrumentHandlerDuration(
+			requestDuration.MustCurryWith(
+				prometheus.Labels{"endpoint": "/reconciliation"},
+			),
+			http.HandlerFunc(c.getReconciliation),
+		),
+	).Methods("GET")
 
 	// Metrics
 	router.Handle("/metrics", promhttp.Handler())
@@ -132,9 +151,6 @@ func (c *Controller) Serve(ctx context.Context, wg *sync.WaitGroup) {
 }
 
 func (c *Controller) getImage(w http.ResponseWriter, r *http.Request) {
-	c.locker.Lock()
-	defer c.locker.Unlock()
-
 	vars := mux.Vars(r)
 	repositoryRef, err := reference.ParseNamed(vars["repository"])
 	if err != nil {
@@ -147,7 +163,11 @@ func (c *Controller) getImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	repository := c.index.Repository(imageRef)
+	repository, err := c.index.Repository(imageRef)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	if repository == nil {
 		http.Error(w, "Repository not found", http.StatusNotFound)
 		return
@@ -163,20 +183,48 @@ func (c *Controller) getImage(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(image)
 }
 
-func (c *Controller) searchRepository(w http.ResponseWriter, r *http.Request) {
-	c.locker.Lock()
-	defer c.locker.Unlock()
-
+func (c *Controller) getImagesByDigest(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	repositoryRef, err := reference.ParseNamed(vars["repository"])
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Invalid repository name: %v", err), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dgst, err := digest.Parse(vars["digest"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	repository := c.index.Repository(repositoryRef)
+	repository, err := c.index.Repository(repositoryRef)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	if repository == nil {
-		http.Error(w, "Not found", http.StatusNotFound)
+		http.Error(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+
+	images := repository.GetImagesByDigest(dgst)
+	if len(images) == 0 {
+		http.Error(w, "Digest not found in repository", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(DigestResponse{
+		Repository: repository.Name.String(),
+		Digest:     dgst.String(),
+		Images:     images,
+	})
+}
+
+func (c *Controller) searchRepository(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	repositoryRef, err := reference.ParseNamed(vars["repository"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid repository name: %v", err), http.StatusBadRequest)
 		return
 	}
 
@@ -209,50 +257,70 @@ func (c *Controller) searchRepository(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	images := make([]*index.Image, 0)
 
-SEARCHLOOP:
-	for _, image := range repository.Images {
-		if !query.CreatedAfter.IsZero() && query.CreatedAfter.After(image.Created) {
-			continue
-		}
-		if !query.CreatedBefore.IsZero() && query.CreatedBefore.Before(image.Created) {
-			continue SEARCHLOOP
-		}
-		for labelKey, labelValue := range query.Labels {
-			value, ok := image.Labels[labelKey]
-			if !ok || value != labelValue {
-				continue SEARCHLOOP
-			}
-		}
-		images = append(images, image)
+	result, err := c.search(repositoryRef, &index.ImageQuery{
+		Labels:        query.Labels,
+		CreatedAfter:  query.CreatedAfter,
+		CreatedBefore: query.CreatedBefore,
+	}, offset, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if result == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
 	}
-	start := utils.MinInt(offset, len(images))
-	end := utils.MinInt(start+limit, len(images))
 	searchResponse := SearchResponse{
-		Repository: repository.Name.String(),
-		Images:     images[start:end],
-		Offset:     start,
+		Repository: reference.TrimNamed(repositoryRef).String(),
+		Images:     result.Images,
+		Offset:     utils.MinInt(offset, result.Count),
 		Limit:      limit,
-		Count:      len(images),
+		Count:      result.Count,
 	}
 
 	w.Header().Set("content-type", "application/json")
 	json.NewEncoder(w).Encode(searchResponse)
 }
 
-func (c *Controller) listRepositories(w http.ResponseWriter, r *http.Request) {
-	c.locker.Lock()
-	defer c.locker.Unlock()
+// search searches the images of a repository with the backend, if it is a
+// Searcher, and otherwise by scanning the repository
+func (c *Controller) search(repositoryRef reference.Named, query *index.ImageQuery, offset int, limit int) (*index.SearchResult, error) {
+	if searcher, ok := c.index.(index.Searcher); ok {
+		return searcher.Search(repositoryRef, query, offset, limit)
+	}
 
-	repositories := make([]RepositoryStatus, 0)
-	for _, repositoryRef := range c.index.Repositories() {
-		repository := c.index.Repository(repositoryRef)
+	repository, err := c.index.Repository(repositoryRef)
+	if err != nil || repository == nil {
+		return nil, err
+	}
+	images := make([]*index.Image, 0)
+	for _, image := range repository.Images {
+		if query.Matches(image) {
+			images = append(images, image)
+		}
+	}
+	start := utils.MinInt(offset, len(images))
+	end := utils.MinInt(start+limit, len(images))
+	return &index.SearchResult{
+		Images: images[start:end],
+		Count:  len(images),
+	}, nil
+}
+
+func (c *Controller) listRepositories(w http.ResponseWriter, r *http.Request) {
+	summaries, err := c.index.Repositories()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	repositories := make([]RepositoryStatus, 0, len(summaries))
+	for _, summary := range summaries {
 		repositories = append(
 			repositories,
 			RepositoryStatus{
-				Name:   repository.Name.String(),
-				Images: len(repository.Images),
+				Name:   summary.Name.String(),
+				Images: summary.Images,
 			},
 		)
 	}
@@ -260,3 +328,14 @@ func (c *Controller) listRepositories(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
 	json.NewEncoder(w).Encode(ListRepositoriesResponse{repositories})
 }
+
+func (c *Controller) getReconciliation(w http.ResponseWriter, r *http.Request) {
+	reconciliation := c.indexer.LastReconciliation()
+	if len(reconciliation.Registries) == 0 {
+		http.Error(w, "No reconciliation has completed yet", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(reconciliation)
+}
@@ -13,6 +13,14 @@ type SearchResponse struct {
 	Count      int            `json:"count"`
 }
 
+// DigestResponse contains all images in a repository,
+// which point at a specific digest
+type DigestResponse struct {
+	Repository string         `json:"name"`
+	Digest     string         `json:"digest"`
+	Images     []*index.Image `json:"images"`
+}
+
 // ListRepositoriesResponse contains the response
 // from listing all repositories
 type ListRepositoriesResponse struct {
@@ -2,6 +2,7 @@ package notifications
 
 import (
 	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
 )
 
 // ActionType describes a type of update action an index can perform
@@ -13,6 +14,9 @@ const (
 	IndexRepositoryAction
 	IndexImageAction
 	DeleteImageAction
+	IndexRegistryAction
+	IndexDigestAction
+	DeleteDigestAction
 )
 
 // Action describes a desired update the index should perform
@@ -20,4 +24,6 @@ type Action struct {
 	Type       ActionType
 	Repository reference.Named
 	Image      reference.NamedTagged
+	Registry   string
+	Digest     digest.Digest
 }
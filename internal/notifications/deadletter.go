@@ -0,0 +1,69 @@
+package notifications
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DeadLetter is an unprocessable webhook request or event. Each line of a
+// dead-letter file is a DeadLetter.
+type DeadLetter struct {
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason"`
+	Format   string    `json:"format"`
+	Registry string    `json:"registry,omitempty"`
+
+	// Request is a request body with only the unprocessable event, which can
+	// be posted to an endpoint of the format again
+	Request json.RawMessage `json:"request,omitempty"`
+
+	// Body is the body of a request, which isn't in the format
+	Body string `json:"body,omitempty"`
+}
+
+// deadLetterFile appends dead letters to a file. Nothing is written if the
+// path is empty.
+type deadLetterFile struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// write writes a dead letter. Failures are logged, as the request has been
+// answered by the time it's dead-lettered.
+func (d *deadLetterFile) write(letter *DeadLetter) {
+	if d.path == "" {
+		return
+	}
+	if letter.Time.IsZero() {
+		letter.Time = time.Now().UTC()
+	}
+	if err := d.append(letter); err != nil {
+		log.Printf("[webhook_listener] Unable to write dead letter: %v", err)
+		return
+	}
+	webhookDeadLetters.Inc()
+}
+
+func (d *deadLetterFile) append(letter *DeadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	file, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(file.Close())
+}
@@ -0,0 +1,60 @@
+package notifications
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	webhookUnauthorized = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "webhook_unauthorized_total",
+			Help:      "Total number of webhook requests rejected as unauthenticated",
+		},
+		[]string{"reason"},
+	)
+
+	webhookRejectedEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "webhook_rejected_events_total",
+			Help:      "Total number of webhook events and requests rejected, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	webhookDeadLetters = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "webhook_dead_letters_total",
+			Help:      "Total number of unprocessable webhook requests and events written to the dead-letter file",
+		},
+	)
+
+	pubsubMessages = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "pubsub_messages_total",
+			Help:      "Total number of Pub/Sub messages received, by result",
+		},
+		[]string{"result"},
+	)
+
+	pollActions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "poll_actions_total",
+			Help:      "Total number of actions enqueued for tags changed since they were polled, by action",
+		},
+		[]string{"action"},
+	)
+
+	pollErrors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "poll_errors_total",
+			Help:      "Total number of failed polls of repositories and catalogs",
+		},
+	)
+)
@@ -0,0 +1,100 @@
+package notifications
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Actions of webhook events. Parsers drop events with other actions, unless
+// they should be logged as unhandled.
+const (
+	PushEvent   = "push"
+	DeleteEvent = "delete"
+)
+
+// WebhookEvent is an event in a webhook request, translated from the format
+// of the registry sending it
+type WebhookEvent struct {
+	ID     string
+	Action string
+
+	// Hosts are the hosts naming the registry of the event, most specific
+	// first
+	Hosts []string
+
+	Repository string
+	Tag        string
+	Digest     digest.Digest
+	MediaType  string
+
+	// Request is a request body with only this event, which can be posted to
+	// the webhook listener again
+	Request json.RawMessage
+}
+
+// Parser translates the body of a webhook request in the format of a
+// registry into events
+type Parser interface {
+	// Parse returns the events in a request body, or an error if the body
+	// isn't in the format of the parser
+	Parse(body []byte) ([]*WebhookEvent, error)
+}
+
+// Formats of webhook requests
+const (
+	DistributionFormat = "distribution"
+	GitLabFormat       = "gitlab"
+	HarborFormat       = "harbor"
+	QuayFormat         = "quay"
+	DockerHubFormat    = "dockerhub"
+	ECRFormat          = "ecr"
+)
+
+var parsers = map[string]Parser{
+	DistributionFormat: &distributionParser{},
+	GitLabFormat:       &distributionParser{},
+	HarborFormat:       &harborParser{},
+	QuayFormat:         &quayParser{},
+	DockerHubFormat:    &dockerHubParser{},
+	ECRFormat:          &ecrParser{},
+}
+
+// replaceField returns a copy of a JSON object with the field at a path of
+// nested objects replaced by value, keeping the other fields as they are
+func replaceField(object json.RawMessage, path []string, value json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(object, &fields); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(path) > 1 {
+		var err error
+		if value, err = replaceField(fields[path[0]], path[1:], value); err != nil {
+			return nil, err
+		}
+	}
+	fields[path[0]] = value
+	replaced, err := json.Marshal(fields)
+	return replaced, errors.WithStack(err)
+}
+
+// GetParser returns the parser of a webhook request format
+func GetParser(format string) (Parser, error) {
+	parser, ok := parsers[format]
+	if !ok {
+		return nil, errors.Errorf("Unknown webhook format %q", format)
+	}
+	return parser, nil
+}
+
+// Formats returns the names of the webhook request formats
+func Formats() []string {
+	formats := make([]string, 0, len(parsers))
+	for format := range parsers {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
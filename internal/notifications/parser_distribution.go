@@ -0,0 +1,51 @@
+package notifications
+
+import (
+	"encoding/json"
+	"net/url"
+
+	"github.com/docker/distribution/notifications"
+	"github.com/pkg/errors"
+)
+
+// distributionParser parses the notification envelopes of Docker Registry,
+// which are also sent by the GitLab Container Registry
+type distributionParser struct{}
+
+func (p *distributionParser) Parse(body []byte) ([]*WebhookEvent, error) {
+	var envelope notifications.Envelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, errors.Wrap(err, "Invalid envelope")
+	}
+
+	events := make([]*WebhookEvent, 0, len(envelope.Events))
+	for _, event := range envelope.Events {
+		if event.Action == "pull" {
+			continue
+		}
+		request, err := json.Marshal(&notifications.Envelope{Events: []notifications.Event{event}})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		var hosts []string
+		if targetURL, err := url.Parse(event.Target.URL); err == nil && targetURL.Host != "" {
+			hosts = append(hosts, targetURL.Host)
+		}
+		if event.Request.Host != "" {
+			hosts = append(hosts, event.Request.Host)
+		}
+
+		events = append(events, &WebhookEvent{
+			ID:         event.ID,
+			Action:     event.Action,
+			Hosts:      hosts,
+			Repository: event.Target.Repository,
+			Tag:        event.Target.Tag,
+			Digest:     event.Target.Digest,
+			MediaType:  event.Target.MediaType,
+			Request:    request,
+		})
+	}
+	return events, nil
+}
@@ -0,0 +1,41 @@
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// dockerHubPayload is the payload of a Docker Hub webhook
+type dockerHubPayload struct {
+	PushData struct {
+		PushedAt int64  `json:"pushed_at"`
+		Tag      string `json:"tag"`
+	} `json:"push_data"`
+	Repository struct {
+		RepoName string `json:"repo_name"`
+	} `json:"repository"`
+}
+
+// dockerHubParser parses the push webhooks of Docker Hub. The payload
+// doesn't name the registry, so the endpoint must.
+type dockerHubParser struct{}
+
+func (p *dockerHubParser) Parse(body []byte) ([]*WebhookEvent, error) {
+	var payload dockerHubPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, errors.Wrap(err, "Invalid Docker Hub payload")
+	}
+	if payload.Repository.RepoName == "" || payload.PushData.Tag == "" {
+		return nil, errors.New("Invalid Docker Hub payload: missing repository or tag")
+	}
+
+	return []*WebhookEvent{{
+		ID:         fmt.Sprintf("%s:%s@%d", payload.Repository.RepoName, payload.PushData.Tag, payload.PushData.PushedAt),
+		Action:     PushEvent,
+		Repository: payload.Repository.RepoName,
+		Tag:        payload.PushData.Tag,
+		Request:    body,
+	}}, nil
+}
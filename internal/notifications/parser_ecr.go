@@ -0,0 +1,61 @@
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// ecrPayload is an ECR Image Action event of Amazon EventBridge
+type ecrPayload struct {
+	ID         string `json:"id"`
+	DetailType string `json:"detail-type"`
+	Source     string `json:"source"`
+	Account    string `json:"account"`
+	Region     string `json:"region"`
+	Detail     struct {
+		Result         string        `json:"result"`
+		RepositoryName string        `json:"repository-name"`
+		ImageDigest    digest.Digest `json:"image-digest"`
+		ActionType     string        `json:"action-type"`
+		ImageTag       string        `json:"image-tag"`
+	} `json:"detail"`
+}
+
+// ecrParser parses the ECR Image Action events of Amazon EventBridge, e.g.
+// delivered by an API destination
+type ecrParser struct{}
+
+func (p *ecrParser) Parse(body []byte) ([]*WebhookEvent, error) {
+	var payload ecrPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, errors.Wrap(err, "Invalid EventBridge event")
+	}
+	if payload.Source != "aws.ecr" {
+		return nil, errors.Errorf("Invalid EventBridge event: source %q isn't aws.ecr", payload.Source)
+	}
+	if payload.DetailType != "ECR Image Action" || payload.Detail.Result != "SUCCESS" {
+		return nil, nil
+	}
+
+	var action string
+	switch payload.Detail.ActionType {
+	case "PUSH":
+		action = PushEvent
+	case "DELETE":
+		action = DeleteEvent
+	default:
+		return nil, nil
+	}
+	return []*WebhookEvent{{
+		ID:         payload.ID,
+		Action:     action,
+		Hosts:      []string{fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", payload.Account, payload.Region)},
+		Repository: payload.Detail.RepositoryName,
+		Tag:        payload.Detail.ImageTag,
+		Digest:     payload.Detail.ImageDigest,
+		Request:    body,
+	}}, nil
+}
@@ -0,0 +1,100 @@
+package notifications
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// harborPayload is the default webhook payload of Harbor
+type harborPayload struct {
+	Type      string `json:"type"`
+	OccurAt   int64  `json:"occur_at"`
+	EventData struct {
+		Resources []struct {
+			Digest      digest.Digest `json:"digest"`
+			Tag         string        `json:"tag"`
+			ResourceURL string        `json:"resource_url"`
+		} `json:"resources"`
+		Repository struct {
+			Name         string `json:"name"`
+			Namespace    string `json:"namespace"`
+			RepoFullName string `json:"repo_full_name"`
+		} `json:"repository"`
+	} `json:"event_data"`
+}
+
+// harborResources are the resources of a Harbor payload as they were sent
+type harborResources struct {
+	EventData struct {
+		Resources []json.RawMessage `json:"resources"`
+	} `json:"event_data"`
+}
+
+// harborParser parses the webhooks of Harbor. Each artifact of a push or
+// delete is an event, with a request of the payload with only its resource.
+type harborParser struct{}
+
+func (p *harborParser) Parse(body []byte) ([]*WebhookEvent, error) {
+	var payload harborPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, errors.Wrap(err, "Invalid Harbor payload")
+	}
+	if payload.Type == "" {
+		return nil, errors.New("Invalid Harbor payload: missing type")
+	}
+
+	var action string
+	switch payload.Type {
+	case "PUSH_ARTIFACT":
+		action = PushEvent
+	case "DELETE_ARTIFACT":
+		action = DeleteEvent
+	default:
+		// Pulls, scans, quotas and replications don't change the index
+		return nil, nil
+	}
+
+	var resources harborResources
+	if err := json.Unmarshal(body, &resources); err != nil {
+		return nil, errors.Wrap(err, "Invalid Harbor payload")
+	}
+
+	repository := payload.EventData.Repository.RepoFullName
+	if repository == "" {
+		repository = payload.EventData.Repository.Namespace + "/" + payload.EventData.Repository.Name
+	}
+	events := make([]*WebhookEvent, 0, len(payload.EventData.Resources))
+	for i, resource := range payload.EventData.Resources {
+		request, err := replaceField(body, []string{"event_data", "resources"}, singleElement(resources.EventData.Resources[i]))
+		if err != nil {
+			return nil, err
+		}
+		tag := resource.Tag
+		if action == DeleteEvent && resource.Digest != "" {
+			// Deleting an artifact deletes every tag of it
+			tag = ""
+		}
+		var hosts []string
+		if i := strings.Index(resource.ResourceURL, "/"); i > 0 {
+			hosts = append(hosts, resource.ResourceURL[:i])
+		}
+		events = append(events, &WebhookEvent{
+			ID:         payload.Type + ":" + resource.ResourceURL,
+			Action:     action,
+			Hosts:      hosts,
+			Repository: repository,
+			Tag:        tag,
+			Digest:     resource.Digest,
+			Request:    request,
+		})
+	}
+	return events, nil
+}
+
+// singleElement returns a JSON array of a single element
+func singleElement(element json.RawMessage) json.RawMessage {
+	return append(append(json.RawMessage("["), element...), ']')
+}
@@ -0,0 +1,55 @@
+package notifications
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// quayPayload is the payload of a Quay repository push notification
+type quayPayload struct {
+	Repository  string   `json:"repository"`
+	DockerURL   string   `json:"docker_url"`
+	UpdatedTags []string `json:"updated_tags"`
+}
+
+// quayParser parses the repository push notifications of Quay. Each updated
+// tag is an event, with a request of the payload with only its tag. Quay
+// sends no notifications of deletes.
+type quayParser struct{}
+
+func (p *quayParser) Parse(body []byte) ([]*WebhookEvent, error) {
+	var payload quayPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, errors.Wrap(err, "Invalid Quay payload")
+	}
+	if payload.Repository == "" {
+		return nil, errors.New("Invalid Quay payload: missing repository")
+	}
+
+	var hosts []string
+	if i := strings.Index(payload.DockerURL, "/"); i > 0 {
+		hosts = append(hosts, payload.DockerURL[:i])
+	}
+	events := make([]*WebhookEvent, 0, len(payload.UpdatedTags))
+	for _, tag := range payload.UpdatedTags {
+		updatedTags, err := json.Marshal([]string{tag})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		request, err := replaceField(body, []string{"updated_tags"}, updatedTags)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &WebhookEvent{
+			ID:         payload.DockerURL + ":" + tag,
+			Action:     PushEvent,
+			Hosts:      hosts,
+			Repository: payload.Repository,
+			Tag:        tag,
+			Request:    request,
+		})
+	}
+	return events, nil
+}
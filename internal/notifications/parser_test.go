@@ -0,0 +1,231 @@
+package notifications
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	distributionDigest = digest.Digest("sha256:fea8895f450959fa676bcc1df0611ea93823a735a01205fd8622846041d0c7cf")
+	gitlabDigest       = digest.Digest("sha256:5b0bcabd1ed22e9fb1310cf6c2dec7cdef19f0ad69efa1f392e94a4333501270")
+	harborDigest       = digest.Digest("sha256:954b378c375d852eb3c63ab88978f640b4348b01c1b3456a024a81536dafbbf4")
+	ecrDigest          = digest.Digest("sha256:7f5b2640fe6fb4f46592dfd3410c4a79dac4f89e4782432e0378abcd12345678")
+)
+
+func TestParsers(t *testing.T) {
+	tests := []struct {
+		format string
+		sample string
+		want   []*WebhookEvent
+	}{
+		{
+			format: DistributionFormat,
+			sample: "push.json",
+			want: []*WebhookEvent{
+				{
+					ID:         "320678d8-ca14-430f-8bb6-4ca139cd83f7",
+					Action:     PushEvent,
+					Hosts:      []string{"registry.example.com:5000", "registry.example.com:5000"},
+					Repository: "team/app",
+					Tag:        "v1",
+					Digest:     distributionDigest,
+					MediaType:  "application/vnd.docker.distribution.manifest.v2+json",
+				},
+				{
+					ID:         "9d1bb1e8-40f4-4b5f-9a51-7b3f1b3bd2a1",
+					Action:     PushEvent,
+					Hosts:      []string{"registry.example.com:5000", "registry.example.com:5000"},
+					Repository: "team/app",
+					Digest:     "sha256:3a1d2d1f8b2e4f7f1f1b6f3d2c0c6e2f9f1f2c0e0f1f2c3d4e5f6a7b8c9d0e1f",
+					MediaType:  "application/vnd.docker.image.rootfs.diff.tar.gzip",
+				},
+			},
+		},
+		{
+			format: DistributionFormat,
+			sample: "delete.json",
+			want: []*WebhookEvent{
+				{
+					ID:         "c2a4ed49-4a0e-4c3b-8a65-47a8c8bfd0d2",
+					Action:     DeleteEvent,
+					Hosts:      []string{"registry.example.com:5000"},
+					Repository: "team/app",
+					Digest:     distributionDigest,
+				},
+			},
+		},
+		{
+			format: GitLabFormat,
+			sample: "push.json",
+			want: []*WebhookEvent{
+				{
+					ID:         "1f7b3c3e-5f0a-4a6c-9a6e-6c6a0f6c2a11",
+					Action:     PushEvent,
+					Hosts:      []string{"registry.gitlab.example.com", "registry.gitlab.example.com"},
+					Repository: "group/project/image",
+					Tag:        "main",
+					Digest:     gitlabDigest,
+					MediaType:  "application/vnd.oci.image.index.v1+json",
+				},
+			},
+		},
+		{
+			format: HarborFormat,
+			sample: "push.json",
+			want: []*WebhookEvent{
+				{
+					ID:         "PUSH_ARTIFACT:harbor.example.com/library/app:v1",
+					Action:     PushEvent,
+					Hosts:      []string{"harbor.example.com"},
+					Repository: "library/app",
+					Tag:        "v1",
+					Digest:     harborDigest,
+				},
+				{
+					ID:         "PUSH_ARTIFACT:harbor.example.com/library/app:latest",
+					Action:     PushEvent,
+					Hosts:      []string{"harbor.example.com"},
+					Repository: "library/app",
+					Tag:        "latest",
+					Digest:     harborDigest,
+				},
+			},
+		},
+		{
+			format: HarborFormat,
+			sample: "delete.json",
+			want: []*WebhookEvent{
+				{
+					ID:         "DELETE_ARTIFACT:harbor.example.com/library/app:v1",
+					Action:     DeleteEvent,
+					Hosts:      []string{"harbor.example.com"},
+					Repository: "library/app",
+					Digest:     harborDigest,
+				},
+			},
+		},
+		{
+			format: HarborFormat,
+			sample: "pull.json",
+		},
+		{
+			format: QuayFormat,
+			sample: "push.json",
+			want: []*WebhookEvent{
+				{
+					ID:         "quay.io/team/app:v1",
+					Action:     PushEvent,
+					Hosts:      []string{"quay.io"},
+					Repository: "team/app",
+					Tag:        "v1",
+				},
+				{
+					ID:         "quay.io/team/app:latest",
+					Action:     PushEvent,
+					Hosts:      []string{"quay.io"},
+					Repository: "team/app",
+					Tag:        "latest",
+				},
+			},
+		},
+		{
+			format: DockerHubFormat,
+			sample: "push.json",
+			want: []*WebhookEvent{
+				{
+					ID:         "team/app:latest@1417566161",
+					Action:     PushEvent,
+					Repository: "team/app",
+					Tag:        "latest",
+				},
+			},
+		},
+		{
+			format: ECRFormat,
+			sample: "push.json",
+			want: []*WebhookEvent{
+				{
+					ID:         "13cde686-328b-6117-af20-0e5566167482",
+					Action:     PushEvent,
+					Hosts:      []string{"123456789012.dkr.ecr.us-west-2.amazonaws.com"},
+					Repository: "team/app",
+					Tag:        "v1",
+					Digest:     ecrDigest,
+				},
+			},
+		},
+		{
+			format: ECRFormat,
+			sample: "delete.json",
+			want: []*WebhookEvent{
+				{
+					ID:         "dd3b46cb-2c74-f49e-393b-28286b67279d",
+					Action:     DeleteEvent,
+					Hosts:      []string{"123456789012.dkr.ecr.us-west-2.amazonaws.com"},
+					Repository: "team/app",
+					Tag:        "v1",
+					Digest:     ecrDigest,
+				},
+			},
+		},
+		{
+			format: ECRFormat,
+			sample: "push-failed.json",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format+"/"+test.sample, func(t *testing.T) {
+			body, err := os.ReadFile(filepath.Join("testdata", test.format, test.sample))
+			if err != nil {
+				t.Fatal(err)
+			}
+			parser, err := GetParser(test.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			events, err := parser.Parse(body)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if len(events) != len(test.want) {
+				t.Fatalf("Parse() returned %d events, want %d", len(events), len(test.want))
+			}
+
+			for i, event := range events {
+				if got := withoutRequest(event); !reflect.DeepEqual(got, test.want[i]) {
+					t.Errorf("event %d = %+v, want %+v", i, got, test.want[i])
+				}
+
+				// The request of an event must hold only that event
+				replayed, err := parser.Parse(event.Request)
+				if err != nil {
+					t.Fatalf("Parse() of the request of event %d error = %v", i, err)
+				}
+				if len(replayed) != 1 || !reflect.DeepEqual(withoutRequest(replayed[0]), test.want[i]) {
+					t.Errorf("request of event %d holds %d events, want only the event", i, len(replayed))
+				}
+			}
+		})
+	}
+}
+
+func TestParsersRejectInvalidPayloads(t *testing.T) {
+	for _, format := range Formats() {
+		parser, _ := GetParser(format)
+		if _, err := parser.Parse([]byte("not json")); err == nil {
+			t.Errorf("%s: Parse() of invalid JSON succeeded", format)
+		}
+	}
+}
+
+// withoutRequest returns a copy of an event without its request
+func withoutRequest(event *WebhookEvent) *WebhookEvent {
+	copy := *event
+	copy.Request = nil
+	return &copy
+}
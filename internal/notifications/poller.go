@@ -0,0 +1,206 @@
+package notifications
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/parmus/registryindexer/pkg/registry"
+	"github.com/pkg/errors"
+)
+
+// PollTarget is a repository, or the repositories with a name prefix, which
+// are polled on an interval
+type PollTarget struct {
+	Repository reference.Named
+	Prefix     string
+	Interval   time.Duration
+}
+
+// String returns the repository or prefix of a target
+func (t PollTarget) String() string {
+	if t.Repository != nil {
+		return t.Repository.Name()
+	}
+	return t.Prefix + "*"
+}
+
+// TagIndex looks up the indexed tags of a repository
+type TagIndex interface {
+	// IndexedTags returns the manifest digest of each indexed tag of a
+	// repository
+	IndexedTags(repositoryRef reference.Named) (map[string]digest.Digest, error)
+}
+
+type poller struct {
+	registryByHost map[string]*registry.Registry
+	index          TagIndex
+	targets        []PollTarget
+	jitter         float64
+	actionQueue    ActionQueue
+}
+
+// NewPoller creates a new Listener, which polls the tags of targets in
+// registries and enqueues actions for the tags which were added, changed or
+// removed since they were indexed. Each interval is varied randomly by up to
+// the fraction jitter, so the polls of targets don't synchronize.
+func NewPoller(actionQueue ActionQueue, index TagIndex, targets []PollTarget, jitter float64, registries ...*registry.Registry) (Listener, error) {
+	p := &poller{
+		registryByHost: make(map[string]*registry.Registry),
+		index:          index,
+		targets:        targets,
+		jitter:         jitter,
+		actionQueue:    actionQueue,
+	}
+	for _, registry := range registries {
+		p.registryByHost[strings.ToLower(registry.Domain())] = registry
+	}
+	for _, target := range targets {
+		if _, err := p.targetRegistry(target); err != nil {
+			return nil, err
+		}
+		if target.Interval <= 0 {
+			return nil, errors.Errorf("Polling of %s has no interval", target)
+		}
+	}
+	return p, nil
+}
+
+// targetRegistry returns the registry of a target
+func (p *poller) targetRegistry(target PollTarget) (*registry.Registry, error) {
+	domain := target.Prefix
+	if target.Repository != nil {
+		domain = reference.Domain(target.Repository)
+	} else if i := strings.Index(domain, "/"); i >= 0 {
+		domain = domain[:i]
+	}
+	registry := p.registryByHost[strings.ToLower(domain)]
+	if registry == nil {
+		return nil, errors.Errorf("Polling of %s: no such registry configured", target)
+	}
+	return registry, nil
+}
+
+func (p *poller) Serve(ctx context.Context, wg *sync.WaitGroup) {
+	for _, target := range p.targets {
+		registry, _ := p.targetRegistry(target)
+		wg.Add(1)
+		go func(target PollTarget) {
+			defer wg.Done()
+
+			// Spread the first polls over the interval
+			timer := time.NewTimer(time.Duration(rand.Int63n(int64(target.Interval))))
+			for {
+				select {
+				case <-timer.C:
+					p.poll(ctx, registry, target)
+					timer.Reset(p.nextInterval(target.Interval))
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+		}(target)
+	}
+}
+
+// nextInterval returns an interval varied randomly by up to the jitter
+func (p *poller) nextInterval(interval time.Duration) time.Duration {
+	return time.Duration(float64(interval) * (1 + p.jitter*(2*rand.Float64()-1)))
+}
+
+// poll polls the repositories of a target
+func (p *poller) poll(ctx context.Context, registry *registry.Registry, target PollTarget) {
+	repositories := []reference.Named{target.Repository}
+	if target.Repository == nil {
+		catalog, err := registry.GetCatalog(ctx)
+		if err != nil {
+			log.Printf("[poller] Failed to list repositories of %s: %v", target, err)
+			pollErrors.Inc()
+			return
+		}
+		repositories = repositories[:0]
+		for _, repositoryRef := range catalog {
+			if strings.HasPrefix(repositoryRef.Name(), target.Prefix) {
+				repositories = append(repositories, repositoryRef)
+			}
+		}
+	}
+
+	enqueued := 0
+	for _, repositoryRef := range repositories {
+		actions, err := p.repositoryActions(ctx, registry, repositoryRef)
+		if err != nil {
+			log.Printf("[poller] Failed to poll %v: %v", repositoryRef, err)
+			pollErrors.Inc()
+		}
+		for _, action := range actions {
+			select {
+			case p.actionQueue <- action:
+				if action.Type == DeleteImageAction {
+					pollActions.WithLabelValues("delete").Inc()
+				} else {
+					pollActions.WithLabelValues("index").Inc()
+				}
+				enqueued++
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+	if enqueued > 0 {
+		log.Printf("[poller] Enqueued %d actions for changed tags of %s", enqueued, target)
+	}
+}
+
+// repositoryActions compares the tags of a repository in the registry with
+// the indexed tags, and returns an action for each added, changed or removed
+// tag. Tags which fail to resolve are skipped until the next poll.
+func (p *poller) repositoryActions(ctx context.Context, registry *registry.Registry, repositoryRef reference.Named) ([]Action, error) {
+	tags, err := registry.GetTags(ctx, repositoryRef)
+	if err != nil {
+		return nil, err
+	}
+	indexed, err := p.index.IndexedTags(repositoryRef)
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []Action
+	var errs []string
+	current := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		current[tag.Tag()] = true
+		if indexedDigest, ok := indexed[tag.Tag()]; ok {
+			dgst, err := registry.GetTagDigest(ctx, tag)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			if dgst == indexedDigest {
+				continue
+			}
+		}
+		actions = append(actions, Action{Type: IndexImageAction, Image: tag})
+	}
+	for tag := range indexed {
+		if current[tag] {
+			continue
+		}
+		imageRef, err := reference.WithTag(repositoryRef, tag)
+		if err != nil {
+			return actions, errors.WithStack(err)
+		}
+		actions = append(actions, Action{Type: DeleteImageAction, Image: imageRef})
+	}
+
+	if len(errs) > 0 {
+		return actions, errors.Errorf("Failed to resolve %d tags: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return actions, nil
+}
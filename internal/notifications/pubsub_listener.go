@@ -4,7 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"strings"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/pubsub"
 	"github.com/parmus/registryindexer/internal/utils"
@@ -17,6 +19,10 @@ const (
 	DefaultSubID = "registryindexer"
 )
 
+// pubsubEnqueueTimeout is how long a message waits for room in the action
+// queue, before it's nacked for redelivery
+var pubsubEnqueueTimeout = 10 * time.Second
+
 type pubsubevent struct {
 	Action string
 	Digest string `json:",omitempty"`
@@ -24,95 +30,194 @@ type pubsubevent struct {
 }
 
 type pubsublistener struct {
-	subscriptions []*pubsub.Subscription
-	prefixes      []string
-	actionQueue   ActionQueue
+	subscriptions           []*pubsub.Subscription
+	deadLetterSubscriptions []*pubsub.Subscription
+	prefixes                []string
+	registries              map[string]bool
+	actionQueue             ActionQueue
 }
 
-// NewPubSubListener creates a new Listener for listening to Google Pub/Sub updates
-func NewPubSubListener(actionQueue ActionQueue, projectIDs []string, prefixes []string, subscriptionID string) (Listener, error) {
+// NewPubSubListener creates a new Listener for listening to Google Pub/Sub
+// updates. Messages are acked once their action is queued, and nacked
+// otherwise, so they're redelivered until the dead-letter policy of the
+// subscription moves them to its dead-letter topic. Messages which can't be
+// processed, like messages for registries other than registries, are nacked
+// too. If deadLetterSubscriptionID is set, the listener also consumes that
+// subscription of the dead-letter topic, and queues the dead letters which
+// can be processed by now.
+func NewPubSubListener(actionQueue ActionQueue, projectIDs []string, prefixes []string, subscriptionID string, deadLetterSubscriptionID string, registries []string) (Listener, error) {
 	if subscriptionID == "" {
 		subscriptionID = DefaultSubID
 	}
 
 	subscriptions := make([]*pubsub.Subscription, 0, len(projectIDs))
+	var deadLetterSubscriptions []*pubsub.Subscription
 	for _, projectID := range projectIDs {
 		if subscription, err := getSubscription(context.Background(), projectID, subscriptionID); err == nil {
 			subscriptions = append(subscriptions, subscription)
 		} else {
 			return nil, err
 		}
+		if deadLetterSubscriptionID == "" {
+			continue
+		}
+		if subscription, err := getSubscription(context.Background(), projectID, deadLetterSubscriptionID); err == nil {
+			deadLetterSubscriptions = append(deadLetterSubscriptions, subscription)
+		} else {
+			return nil, err
+		}
 	}
 
-	return &pubsublistener{
-		subscriptions: subscriptions,
-		prefixes:      prefixes,
-		actionQueue:   actionQueue,
-	}, nil
+	listener := &pubsublistener{
+		subscriptions:           subscriptions,
+		deadLetterSubscriptions: deadLetterSubscriptions,
+		prefixes:                prefixes,
+		registries:              make(map[string]bool),
+		actionQueue:             actionQueue,
+	}
+	for _, registry := range registries {
+		listener.registries[strings.ToLower(registry)] = true
+	}
+	return listener, nil
 
 }
 
 func (l *pubsublistener) Serve(ctx context.Context, wg *sync.WaitGroup) {
 	for _, subscription := range l.subscriptions {
-		wg.Add(1)
-		go func(subscription *pubsub.Subscription) {
-			defer wg.Done()
-
-			err := subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-				var event pubsubevent
-				if err := json.Unmarshal(msg.Data, &event); err != nil {
-					log.Printf("[Pubsub message %v] Invalid event", msg.ID)
-					return
-				}
-				defer msg.Ack()
-
-				if event.Tag == "" {
-					// TODO: Count in monitoring
-					return
-				}
-
-				distributionRef, err := reference.ParseNamed(event.Tag)
-				if err != nil {
-					log.Printf("[Pubsub message %v] %v", msg.ID, err)
-					return
-				}
-
-				if len(l.prefixes) > 0 && !utils.HasAnyPrefix(l.prefixes, distributionRef.Name()) {
-					// TODO: Count in monitoring
-					log.Printf("[Pubsub message %v] %s doesn't match any of the allowed prefixes", msg.ID, distributionRef.Name())
-					return
-				}
-
-				tagged, ok := distributionRef.(reference.NamedTagged)
-				if !ok {
-					log.Printf("[Pubsub message %v] Ignored because tag is missing", msg.ID)
-					return
-				}
-
-				switch event.Action {
-				case "INSERT":
-					l.actionQueue <- Action{
-						Type:  IndexImageAction,
-						Image: tagged,
-					}
-				case "DELETE":
-					l.actionQueue <- Action{
-						Type:  DeleteImageAction,
-						Image: tagged,
-					}
-				default:
-					log.Printf("Unhandled event type received: %v\n", event.Action)
-				}
-			})
-			if err != nil {
-				log.Printf("PubSub subscription %v failed: %+v", subscription, err)
-			} else {
-				log.Printf("Shutting down pubsub subscription")
-			}
-		}(subscription)
+		l.serveSubscription(ctx, wg, subscription, l.receive)
+	}
+	for _, subscription := range l.deadLetterSubscriptions {
+		l.serveSubscription(ctx, wg, subscription, l.receiveDeadLetter)
+	}
+}
+
+// serveSubscription receives the messages of a subscription with receive
+// until the context is cancelled
+func (l *pubsublistener) serveSubscription(ctx context.Context, wg *sync.WaitGroup, subscription *pubsub.Subscription, receive func(ctx context.Context, msg *pubsub.Message)) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		err := subscription.Receive(ctx, receive)
+		if err != nil {
+			log.Printf("PubSub subscription %v failed: %+v", subscription, err)
+		} else {
+			log.Printf("Shutting down pubsub subscription %v", subscription)
+		}
+	}()
+}
+
+// receive acks a message once its action is queued. Messages, which can't
+// be processed or queued, are nacked, so they aren't lost, but redelivered
+// until the dead-letter policy of the subscription moves them aside.
+func (l *pubsublistener) receive(ctx context.Context, msg *pubsub.Message) {
+	action, err := l.messageAction(msg)
+	if err != nil {
+		log.Printf("[Pubsub message %v] Nacking: %v", msg.ID, err)
+		msg.Nack()
+		return
+	}
+	if action == nil {
+		pubsubMessages.WithLabelValues("ignored").Inc()
+		msg.Ack()
+		return
+	}
+
+	timer := time.NewTimer(pubsubEnqueueTimeout)
+	defer timer.Stop()
+	select {
+	case l.actionQueue <- *action:
+		pubsubMessages.WithLabelValues("queued").Inc()
+		msg.Ack()
+	case <-timer.C:
+		log.Printf("[Pubsub message %v] Action queue full, nacking", msg.ID)
+		pubsubMessages.WithLabelValues("queue-full").Inc()
+		msg.Nack()
+	case <-ctx.Done():
+		msg.Nack()
 	}
 }
 
+// receiveDeadLetter receives a message of the dead-letter subscription like
+// receive. Dead letters, which still can't be processed, are nacked and stay
+// in the dead-letter subscription for inspection.
+func (l *pubsublistener) receiveDeadLetter(ctx context.Context, msg *pubsub.Message) {
+	pubsubMessages.WithLabelValues("dead-letter").Inc()
+	l.receive(ctx, msg)
+}
+
+// messageAction returns the action of a message, or nil if the message needs
+// no action. An error is returned for a message, which can never be processed.
+func (l *pubsublistener) messageAction(msg *pubsub.Message) (*Action, error) {
+	var event pubsubevent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		pubsubMessages.WithLabelValues("invalid").Inc()
+		return nil, errors.Wrap(err, "Invalid event")
+	}
+
+	name := event.Tag
+	if name == "" {
+		name = event.Digest
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	distributionRef, err := reference.ParseNamed(name)
+	if err != nil {
+		pubsubMessages.WithLabelValues("invalid").Inc()
+		return nil, errors.WithStack(err)
+	}
+
+	if len(l.prefixes) > 0 && !utils.HasAnyPrefix(l.prefixes, distributionRef.Name()) {
+		log.Printf("[Pubsub message %v] %s doesn't match any of the allowed prefixes", msg.ID, distributionRef.Name())
+		return nil, nil
+	}
+
+	if domain := reference.Domain(distributionRef); !l.registries[domain] {
+		pubsubMessages.WithLabelValues("unknown-registry").Inc()
+		return nil, errors.Errorf("Registry %s of %s isn't configured", domain, distributionRef.Name())
+	}
+
+	if tagged, ok := distributionRef.(reference.NamedTagged); ok {
+		switch event.Action {
+		case "INSERT":
+			return &Action{
+				Type:  IndexImageAction,
+				Image: tagged,
+			}, nil
+		case "DELETE":
+			return &Action{
+				Type:  DeleteImageAction,
+				Image: tagged,
+			}, nil
+		}
+	} else if canonical, ok := distributionRef.(reference.Canonical); ok {
+		switch event.Action {
+		case "INSERT":
+			return &Action{
+				Type:       IndexDigestAction,
+				Repository: reference.TrimNamed(canonical),
+				Digest:     canonical.Digest(),
+			}, nil
+		case "DELETE":
+			return &Action{
+				Type:       DeleteDigestAction,
+				Repository: reference.TrimNamed(canonical),
+				Digest:     canonical.Digest(),
+			}, nil
+		}
+	} else {
+		log.Printf("[Pubsub message %v] Ignored because tag and digest are missing", msg.ID)
+		return nil, nil
+	}
+
+	log.Printf("Unhandled event type received: %v\n", event.Action)
+	return nil, nil
+}
+
+// getSubscription returns a subscription of a project. The client connects
+// to the Pub/Sub emulator at PUBSUB_EMULATOR_HOST, if it's set.
 func getSubscription(ctx context.Context, projectID string, subID string) (*pubsub.Subscription, error) {
 	client, err := pubsub.NewClient(ctx, projectID)
 	if err != nil {
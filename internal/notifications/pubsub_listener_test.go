@@ -0,0 +1,228 @@
+package notifications
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// newEmulatorSubscription creates a topic and a subscription of it in the
+// Pub/Sub emulator at PUBSUB_EMULATOR_HOST, or skips the test without one
+func newEmulatorSubscription(t *testing.T, projectID string) (*pubsub.Topic, *pubsub.Subscription) {
+	if os.Getenv("PUBSUB_EMULATOR_HOST") == "" {
+		t.Skip("PUBSUB_EMULATOR_HOST isn't set")
+	}
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	name := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+	topic, err := client.CreateTopic(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription, err := client.CreateSubscription(ctx, name, pubsub.SubscriptionConfig{
+		Topic:       topic,
+		AckDeadline: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		subscription.Delete(context.Background())
+		topic.Delete(context.Background())
+	})
+	return topic, subscription
+}
+
+func publish(t *testing.T, topic *pubsub.Topic, messages ...string) {
+	ctx := context.Background()
+	for _, message := range messages {
+		if _, err := topic.Publish(ctx, &pubsub.Message{Data: []byte(message)}).Get(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serve runs a listener for a duration, and returns the actions read from
+// actions meanwhile
+func serve(t *testing.T, listener Listener, actions <-chan Action, duration time.Duration) []string {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	listener.Serve(ctx, wg)
+
+	var queued []string
+	timeout := time.After(duration)
+loop:
+	for {
+		select {
+		case action := <-actions:
+			queued = append(queued, describeAction(action))
+		case <-timeout:
+			break loop
+		}
+	}
+	cancel()
+	wg.Wait()
+	sort.Strings(queued)
+	return queued
+}
+
+// redelivered returns the distinct messages of a subscription, which weren't
+// acked.
+// It waits for up to 10 seconds for count messages, or 3 seconds for none.
+func redelivered(t *testing.T, subscription *pubsub.Subscription, count int) []string {
+	timeout := 10 * time.Second
+	if count == 0 {
+		timeout = 3 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var mutex sync.Mutex
+	var messages []string
+	seen := make(map[string]bool)
+	err := subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		msg.Ack()
+		if seen[string(msg.Data)] {
+			return
+		}
+		seen[string(msg.Data)] = true
+		messages = append(messages, string(msg.Data))
+		if len(messages) >= count && count > 0 {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(messages)
+	return messages
+}
+
+func describeAction(action Action) string {
+	switch action.Type {
+	case IndexImageAction:
+		return "index " + action.Image.String()
+	case DeleteImageAction:
+		return "delete " + action.Image.String()
+	case IndexDigestAction:
+		return "index " + action.Repository.String() + "@" + action.Digest.String()
+	case DeleteDigestAction:
+		return "delete " + action.Repository.String() + "@" + action.Digest.String()
+	default:
+		return fmt.Sprintf("action %d", action.Type)
+	}
+}
+
+func TestPubSubListenerAcksProcessedMessages(t *testing.T) {
+	topic, subscription := newEmulatorSubscription(t, "registryindexer-test")
+	publish(t, topic,
+		`{"action":"INSERT","digest":"gcr.io/project/app@`+testDigest+`","tag":"gcr.io/project/app:v1"}`,
+		`{"action":"DELETE","tag":"gcr.io/project/app:v2"}`,
+		`{"action":"INSERT","digest":"gcr.io/project/app@`+testDigest+`"}`,
+		`{"action":"DELETE","digest":"gcr.io/project/app@`+testDigest+`"}`,
+	)
+
+	actionQueue := make(chan Action, 10)
+	listener, err := NewPubSubListener(actionQueue, []string{"registryindexer-test"}, nil, subscription.ID(), "", []string{"gcr.io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := serve(t, listener, actionQueue, 3*time.Second)
+
+	want := []string{
+		"delete gcr.io/project/app:v2",
+		"delete gcr.io/project/app@" + testDigest,
+		"index gcr.io/project/app:v1",
+		"index gcr.io/project/app@" + testDigest,
+	}
+	if fmt.Sprint(actions) != fmt.Sprint(want) {
+		t.Errorf("queued actions = %q, want %q", actions, want)
+	}
+	if messages := redelivered(t, subscription, 0); len(messages) > 0 {
+		t.Errorf("redelivered messages = %q, want none", messages)
+	}
+}
+
+func TestPubSubListenerNacksUnprocessableMessages(t *testing.T) {
+	topic, subscription := newEmulatorSubscription(t, "registryindexer-test")
+	unprocessable := []string{
+		`not json`,
+		`{"action":"INSERT","tag":"Invalid Reference"}`,
+		`{"action":"INSERT","tag":"eu.gcr.io/project/app:v1"}`,
+	}
+	publish(t, topic, unprocessable...)
+
+	actionQueue := make(chan Action, 10)
+	listener, err := NewPubSubListener(actionQueue, []string{"registryindexer-test"}, nil, subscription.ID(), "", []string{"gcr.io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions := serve(t, listener, actionQueue, 2*time.Second); len(actions) > 0 {
+		t.Errorf("queued actions = %q, want none", actions)
+	}
+
+	sort.Strings(unprocessable)
+	if messages := redelivered(t, subscription, len(unprocessable)); fmt.Sprint(messages) != fmt.Sprint(unprocessable) {
+		t.Errorf("redelivered messages = %q, want %q", messages, unprocessable)
+	}
+}
+
+func TestPubSubListenerNacksWhenQueueIsFull(t *testing.T) {
+	topic, subscription := newEmulatorSubscription(t, "registryindexer-test")
+	defer func(timeout time.Duration) { pubsubEnqueueTimeout = timeout }(pubsubEnqueueTimeout)
+	pubsubEnqueueTimeout = 100 * time.Millisecond
+
+	message := `{"action":"INSERT","tag":"gcr.io/project/app:v1"}`
+	publish(t, topic, message)
+
+	// Nothing reads the unbuffered queue, so it's always full
+	actionQueue := make(chan Action)
+	listener, err := NewPubSubListener(actionQueue, []string{"registryindexer-test"}, nil, subscription.ID(), "", []string{"gcr.io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, listener, nil, time.Second)
+
+	messages := redelivered(t, subscription, 1)
+	if len(messages) == 0 || messages[0] != message {
+		t.Errorf("redelivered messages = %q, want %q", messages, message)
+	}
+}
+
+func TestPubSubListenerConsumesDeadLetters(t *testing.T) {
+	_, subscription := newEmulatorSubscription(t, "registryindexer-test")
+	deadLetterTopic, deadLetterSubscription := newEmulatorSubscription(t, "registryindexer-test")
+	unprocessable := `{"action":"INSERT","tag":"eu.gcr.io/project/app:v1"}`
+	publish(t, deadLetterTopic, `{"action":"INSERT","tag":"gcr.io/project/app:v1"}`, unprocessable)
+
+	actionQueue := make(chan Action, 10)
+	listener, err := NewPubSubListener(actionQueue, []string{"registryindexer-test"}, nil, subscription.ID(), deadLetterSubscription.ID(), []string{"gcr.io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := serve(t, listener, actionQueue, 2*time.Second)
+
+	// Dead letters, which can be processed by now, are queued, and the rest
+	// stay in the dead-letter subscription
+	if want := []string{"index gcr.io/project/app:v1"}; fmt.Sprint(actions) != fmt.Sprint(want) {
+		t.Errorf("queued actions = %q, want %q", actions, want)
+	}
+	if messages := redelivered(t, deadLetterSubscription, 1); len(messages) != 1 || messages[0] != unprocessable {
+		t.Errorf("redelivered dead letters = %q, want %q", messages, unprocessable)
+	}
+}
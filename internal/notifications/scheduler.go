@@ -0,0 +1,64 @@
+package notifications
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+type scheduler struct {
+	schedule    cron.Schedule
+	registries  []string
+	actionQueue ActionQueue
+}
+
+// NewScheduler creates a new Listener, which enqueues reconciliations on a
+// schedule. If registries are given, a reconciliation of each registry is
+// enqueued, otherwise a single reconciliation of all registries.
+func NewScheduler(actionQueue ActionQueue, schedule cron.Schedule, registries ...string) Listener {
+	return &scheduler{
+		schedule:    schedule,
+		registries:  registries,
+		actionQueue: actionQueue,
+	}
+}
+
+func (s *scheduler) Serve(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			timer := time.NewTimer(time.Until(s.schedule.Next(time.Now())))
+			select {
+			case <-timer.C:
+				s.enqueue(ctx)
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (s *scheduler) enqueue(ctx context.Context) {
+	actions := []Action{{Type: IndexAllAction}}
+	if len(s.registries) > 0 {
+		actions = make([]Action, 0, len(s.registries))
+		for _, registry := range s.registries {
+			actions = append(actions, Action{Type: IndexRegistryAction, Registry: registry})
+		}
+	}
+
+	for _, action := range actions {
+		select {
+		case s.actionQueue <- action:
+		case <-ctx.Done():
+			return
+		}
+	}
+	log.Printf("[scheduler] Enqueued %d scheduled reconciliations", len(actions))
+}
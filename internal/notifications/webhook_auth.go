@@ -0,0 +1,134 @@
+package notifications
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SignatureHeader is the header carrying the HMAC-SHA256 signature of a
+// webhook request body, as "sha256=" followed by the hex encoded signature
+const SignatureHeader = "X-Hub-Signature-256"
+
+// WebhookAuth authenticates webhook requests. Every configured check must
+// pass, and a zero WebhookAuth accepts any request.
+type WebhookAuth struct {
+	// Token is the bearer token expected in the Authorization header, or in
+	// the token query parameter from registries unable to send headers
+	Token string
+
+	// HMACSecret is the key of the body signature expected in SignatureHeader
+	HMACSecret string
+
+	// AllowedNetworks are the networks requests may come from
+	AllowedNetworks []*net.IPNet
+}
+
+// ParseNetworks parses a list of IP addresses and CIDR networks
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, errors.Errorf("Invalid IP address %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid network %q", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Enabled reports whether any check is configured
+func (a *WebhookAuth) Enabled() bool {
+	return a.Token != "" || a.HMACSecret != "" || len(a.AllowedNetworks) > 0
+}
+
+// authenticate wraps a handler, so it only receives authenticated requests.
+// Other requests are rejected with 401 Unauthorized.
+func (a *WebhookAuth) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if reason := a.check(r); reason != "" {
+			log.Printf("[webhook_listener] Rejected request from %s: invalid %s", r.RemoteAddr, reason)
+			webhookUnauthorized.WithLabelValues(reason).Inc()
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// check returns why a request isn't authenticated, or an empty string if it
+// is. The body is read to check its signature, and replaced by a copy.
+func (a *WebhookAuth) check(r *http.Request) string {
+	if len(a.AllowedNetworks) > 0 && !a.allowed(r.RemoteAddr) {
+		return "address"
+	}
+
+	if a.Token != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			return "token"
+		}
+	}
+
+	if a.HMACSecret != "" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return "signature"
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		signature, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get(SignatureHeader), "sha256="))
+		if err != nil {
+			return "signature"
+		}
+		mac := hmac.New(sha256.New, []byte(a.HMACSecret))
+		mac.Write(body)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return "signature"
+		}
+	}
+	return ""
+}
+
+// allowed reports whether a remote address is in an allowed network
+func (a *WebhookAuth) allowed(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range a.AllowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,40 +2,77 @@ package notifications
 
 import (
 	"context"
-	"encoding/json"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"path"
+	"strings"
 	"sync"
 
-	"github.com/docker/distribution/notifications"
 	"github.com/docker/distribution/reference"
 	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+	"github.com/parmus/registryindexer/pkg/registry"
+	"github.com/pkg/errors"
 )
 
+// WebhookEndpoint is a path of the webhook listener, which receives webhook
+// requests in a format
+type WebhookEndpoint struct {
+	Path   string
+	Format string
+
+	// Registry is the registry events belong in, or empty if they belong in
+	// the registry named in the event
+	Registry string
+}
+
 type webhookListener struct {
-	registry    string
+	registries  map[string]bool
 	actionQueue ActionQueue
+	deadLetters *deadLetterFile
 	server      *http.Server
+
+	// enqueueMutex makes checking the room in the action queue and queueing
+	// the actions of a request atomic between requests
+	enqueueMutex sync.Mutex
 }
 
-// NewWebHookLister creates a new Listener for listening to webhook updates
-func NewWebHookLister(actionQueue ActionQueue, registry string, listen string) Listener {
+// NewWebHookLister creates a new Listener for listening to webhook updates on
+// endpoints, which only accepts requests authenticated by auth. Unprocessable
+// events are appended to the file at deadLetterPath, unless it's empty.
+//
+// Events posted to the path of an endpoint followed by /{registry} belong in
+// that registry. Events for registries other than registries are rejected.
+func NewWebHookLister(actionQueue ActionQueue, endpoints []WebhookEndpoint, registries []string, listen string, auth WebhookAuth, deadLetterPath string) (Listener, error) {
 	router := mux.NewRouter()
 	listener := &webhookListener{
-		registry:    registry,
+		registries:  make(map[string]bool),
 		actionQueue: actionQueue,
+		deadLetters: &deadLetterFile{path: deadLetterPath},
 		server: &http.Server{
 			Addr:    listen,
 			Handler: router,
 		},
 	}
-	router.HandleFunc(
-		"/event",
-		listener.handlerFunc,
-	).Methods("POST")
+	if !auth.Enabled() {
+		log.Printf("[webhook_listener] No authentication configured, accepting events from anyone")
+	}
+	for _, registry := range registries {
+		listener.registries[strings.ToLower(registry)] = true
+	}
+	for _, endpoint := range endpoints {
+		parser, err := GetParser(endpoint.Format)
+		if err != nil {
+			return nil, err
+		}
+		handler := auth.authenticate(listener.handlerFunc(endpoint, parser))
+		router.HandleFunc(endpoint.Path, handler).Methods("POST")
+		router.HandleFunc(path.Join(endpoint.Path, "{registry}"), handler).Methods("POST")
+	}
 
-	return listener
+	return listener, nil
 }
 
 func (l *webhookListener) Serve(ctx context.Context, wg *sync.WaitGroup) {
@@ -54,62 +91,195 @@ func (l *webhookListener) Serve(ctx context.Context, wg *sync.WaitGroup) {
 	}()
 }
 
-// NewWebhookHandler creates a new webhook event handler function
-func (l *webhookListener) handlerFunc(w http.ResponseWriter, r *http.Request) {
-	var envelope notifications.Envelope
-	err := json.NewDecoder(r.Body).Decode(&envelope)
-	if err != nil {
-		log.Printf("Invalid envelope")
-		return
-	}
-
-	for _, event := range envelope.Events {
-		if event.Target.Tag == "" {
-			// Silenty skip actions without tags
-			continue
+// handlerFunc creates a handler function of webhook requests to an endpoint.
+//
+// The actions of a request are either all queued, or the request gets a 503
+// response without queueing any of them, so the registry retrying it doesn't
+// queue an action twice. A request with more actions than the queue holds is
+// dead-lettered with a 413 response. Unprocessable events are dead-lettered,
+// and don't fail the request: they get a 200 response by design, as a retry
+// by the registry would fail the same way.
+func (l *webhookListener) handlerFunc(endpoint WebhookEndpoint, parser Parser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		registry := strings.ToLower(endpoint.Registry)
+		if name, ok := mux.Vars(r)["registry"]; ok {
+			registry = strings.ToLower(name)
+			if !l.registries[registry] {
+				log.Printf("[webhook_listener] Rejected events for unknown registry %s", name)
+				webhookRejectedEvents.WithLabelValues("unknown-registry").Inc()
+				http.Error(w, "Unknown registry", http.StatusNotFound)
+				return
+			}
 		}
 
-		repositoryRef, err := reference.WithName(path.Join(l.registry, event.Target.Repository))
+		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.Printf("[webhook_listener] Invalid target.repository field in event %s: %s", event.ID, err)
-			if out, err := json.Marshal(event); err == nil {
-				log.Printf("> %v", string(out))
-			}
-			continue
+			http.Error(w, "Unable to read request", http.StatusBadRequest)
+			return
 		}
-		imageRef, err := reference.WithTag(repositoryRef, event.Target.Tag)
+		events, err := parser.Parse(body)
 		if err != nil {
-			log.Printf("[webhook_listener] Invalid target.tag field in event %s: %s", event.ID, err)
-			if out, err := json.Marshal(event); err == nil {
-				log.Printf("> %v", string(out))
-			}
-			continue
+			log.Printf("[webhook_listener] %v", err)
+			webhookRejectedEvents.WithLabelValues("invalid-request").Inc()
+			l.deadLetters.write(&DeadLetter{Reason: err.Error(), Format: endpoint.Format, Registry: registry, Body: string(body)})
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
 		}
 
-		switch event.Action {
-		case "push":
-			if event.Target.Tag != "" {
-				log.Printf("[webhook_listener] Reindexing %v", imageRef)
-				l.actionQueue <- Action{
-					Type:  IndexImageAction,
-					Image: imageRef,
-				}
+		actions := make([]Action, 0, len(events))
+		for _, event := range events {
+			action, err := l.eventAction(registry, event)
+			if err != nil {
+				log.Printf("[webhook_listener] %v", err)
+				l.deadLetters.write(&DeadLetter{Reason: err.Error(), Format: endpoint.Format, Registry: registry, Request: event.Request})
+				continue
 			}
-		case "delete":
-			if event.Target.Tag != "" {
-				log.Printf("[webhook_listener] Deleting %v", imageRef)
-				l.actionQueue <- Action{
-					Type:  DeleteImageAction,
-					Image: imageRef,
-				}
+			if action != nil {
+				actions = append(actions, *action)
 			}
-		case "pull":
-			continue
-		default:
-			log.Printf("Unhandled event type received: %v\n", event.Action)
-			if out, err := json.Marshal(event); err == nil {
-				log.Printf("> %v", string(out))
+		}
+
+		if len(actions) > cap(l.actionQueue) {
+			// The request would never fit in the queue, and only get retried
+			err := errors.Errorf("Request has %d actions, more than the action queue holds", len(actions))
+			log.Printf("[webhook_listener] %v", err)
+			webhookRejectedEvents.WithLabelValues("too-large").Inc()
+			l.deadLetters.write(&DeadLetter{Reason: err.Error(), Format: endpoint.Format, Registry: registry, Body: string(body)})
+			http.Error(w, "Too many events", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		l.enqueueMutex.Lock()
+		defer l.enqueueMutex.Unlock()
+		if room := cap(l.actionQueue) - len(l.actionQueue); room < len(actions) {
+			log.Printf("[webhook_listener] Action queue full, rejecting %d actions", len(actions))
+			webhookRejectedEvents.WithLabelValues("queue-full").Inc()
+			http.Error(w, "Action queue full", http.StatusServiceUnavailable)
+			return
+		}
+		for i, action := range actions {
+			select {
+			case l.actionQueue <- action:
+			default:
+				// Other listeners filled the queue meanwhile. The actions are
+				// idempotent, so the retry queueing some of them twice does
+				// no harm.
+				log.Printf("[webhook_listener] Action queue full, rejecting %d of %d actions", len(actions)-i, len(actions))
+				webhookRejectedEvents.WithLabelValues("queue-full").Inc()
+				http.Error(w, "Action queue full", http.StatusServiceUnavailable)
+				return
 			}
 		}
 	}
 }
+
+// eventAction returns the action of an event in registry, or nil if the
+// event needs no action. An error is returned for an unprocessable event.
+func (l *webhookListener) eventAction(registry string, event *WebhookEvent) (*Action, error) {
+	if event.Tag == "" && (event.Digest == "" || !isManifest(event.MediaType)) {
+		// Silenty skip actions on blobs, or without tags and digests
+		return nil, nil
+	}
+
+	domain := registry
+	if domain == "" {
+		if domain = l.eventRegistry(event); domain == "" {
+			webhookRejectedEvents.WithLabelValues("unknown-registry").Inc()
+			return nil, errors.Errorf("Rejected event %s for unknown registry (hosts %q)", event.ID, event.Hosts)
+		}
+	}
+
+	repositoryRef, err := reference.WithName(path.Join(domain, event.Repository))
+	if err != nil {
+		webhookRejectedEvents.WithLabelValues("invalid").Inc()
+		return nil, errors.Errorf("Invalid repository in event %s: %s", event.ID, err)
+	}
+
+	if event.Tag == "" {
+		if err := event.Digest.Validate(); err != nil {
+			webhookRejectedEvents.WithLabelValues("invalid").Inc()
+			return nil, errors.Errorf("Invalid digest in event %s: %s", event.ID, err)
+		}
+		return digestAction(event.Action, repositoryRef, event.Digest), nil
+	}
+
+	imageRef, err := reference.WithTag(repositoryRef, event.Tag)
+	if err != nil {
+		webhookRejectedEvents.WithLabelValues("invalid").Inc()
+		return nil, errors.Errorf("Invalid tag in event %s: %s", event.ID, err)
+	}
+
+	switch event.Action {
+	case PushEvent:
+		log.Printf("[webhook_listener] Reindexing %v", imageRef)
+		return &Action{
+			Type:  IndexImageAction,
+			Image: imageRef,
+		}, nil
+	case DeleteEvent:
+		log.Printf("[webhook_listener] Deleting %v", imageRef)
+		return &Action{
+			Type:  DeleteImageAction,
+			Image: imageRef,
+		}, nil
+	default:
+		log.Printf("Unhandled event type received: %v\n", event.Action)
+		log.Printf("> %v", string(event.Request))
+		return nil, nil
+	}
+}
+
+// digestAction returns the action of an event on a manifest without a tag.
+// Pushing a digest reindexes the tags pointing to it, and deleting a digest
+// deletes the tags pointing to it.
+func digestAction(action string, repositoryRef reference.Named, dgst digest.Digest) *Action {
+	switch action {
+	case PushEvent:
+		log.Printf("[webhook_listener] Reindexing tags of %v@%v", repositoryRef, dgst)
+		return &Action{
+			Type:       IndexDigestAction,
+			Repository: repositoryRef,
+			Digest:     dgst,
+		}
+	case DeleteEvent:
+		log.Printf("[webhook_listener] Deleting tags of %v@%v", repositoryRef, dgst)
+		return &Action{
+			Type:       DeleteDigestAction,
+			Repository: repositoryRef,
+			Digest:     dgst,
+		}
+	default:
+		log.Printf("Unhandled event type received: %v\n", action)
+		return nil
+	}
+}
+
+// isManifest reports whether an event targets a manifest. Delete events
+// carry no media type, and are assumed to target a manifest.
+func isManifest(mediaType string) bool {
+	if mediaType == "" {
+		return true
+	}
+	for _, manifestMediaType := range registry.ManifestMediaTypes {
+		if mediaType == manifestMediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// eventRegistry returns the known registry named by the hosts of an event,
+// or an empty string
+func (l *webhookListener) eventRegistry(event *WebhookEvent) string {
+	for _, host := range event.Hosts {
+		host = strings.ToLower(host)
+		if l.registries[host] {
+			return host
+		}
+		// The host of a registry on the default port may include the port
+		if hostname, port, err := net.SplitHostPort(host); err == nil && (port == "443" || port == "80") && l.registries[hostname] {
+			return hostname
+		}
+	}
+	return ""
+}
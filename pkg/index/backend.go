@@ -0,0 +1,136 @@
+package index
+
+import (
+	"sort"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// Backend stores an index of images. The in-memory Index is the default
+// backend, BoltBackend keeps the index on disk, and only caches the
+// repositories in use in memory, and SQLiteBackend keeps the index in
+// normalized tables of a SQLite database.
+//
+// Repositories returned by a backend must not be modified.
+type Backend interface {
+	// Repository returns a single repository, or nil if it isn't indexed
+	Repository(repositoryRef reference.Named) (*Repository, error)
+
+	// Repositories returns a summary of all repositories sorted by name
+	Repositories() ([]*RepositorySummary, error)
+
+	// ForEachImage calls fn for each indexed image in a consistent view of
+	// the index, until fn returns an error. fn must not modify the backend.
+	ForEachImage(fn func(repositoryRef reference.Named, image *Image) error) error
+
+	// ReplaceRepository atomically replaces a single repository
+	ReplaceRepository(repository *Repository) error
+
+	// ReplaceImage atomically replaces a single image
+	ReplaceImage(imageRef reference.NamedTagged, image *Image) error
+
+	// DeleteImage deletes an image from a repository
+	DeleteImage(imageRef reference.NamedTagged) error
+
+	// DeleteDigest atomically deletes every image in a repository with a
+	// manifest digest, and returns the deleted tags
+	DeleteDigest(repositoryRef reference.Named, dgst digest.Digest) ([]string, error)
+
+	// Mutations returns the number of times the index has been changed
+	Mutations() uint64
+
+	// Close releases the resources of the backend
+	Close() error
+
+	// domainRepositories returns the names of the indexed repositories in a
+	// registry domain
+	domainRepositories(domain string) ([]reference.Named, error)
+
+	// repositoryImages returns the indexed images of a repository by tag, or
+	// nil if it isn't indexed
+	repositoryImages(repositoryRef reference.Named) (map[string]*Image, error)
+
+	// reconcileRepository atomically applies the difference between a
+	// crawled repository, or nil if it's gone from the registry, and the
+	// images indexed when its crawl started
+	reconcileRepository(repositoryRef reference.Named, baseline map[string]*Image, crawled *Repository, result *RegistryReconciliation) error
+
+	// persist saves the index to a StateStorage, unless the backend is
+	// persistent itself
+	persist(storage StateStorage) error
+}
+
+// deleteDigestChanges returns the changes deleting every image in a
+// repository with a manifest digest. Images with a platform of the digest
+// aren't deleted, as their tags don't resolve to it.
+func deleteDigestChanges(repository *Repository, dgst digest.Digest) []*JournalEntry {
+	var changes []*JournalEntry
+	for _, image := range repository.GetImagesByDigest(dgst) {
+		if image.Digest != dgst {
+			continue
+		}
+		changes = append(changes, &JournalEntry{
+			Operation:  JournalDeleteImage,
+			Repository: repository.Name.String(),
+			Tag:        image.Tag,
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Tag < changes[j].Tag })
+	return changes
+}
+
+// changedTags returns the tags of a list of changes
+func changedTags(changes []*JournalEntry) []string {
+	tags := make([]string, len(changes))
+	for i, change := range changes {
+		tags[i] = change.Tag
+	}
+	return tags
+}
+
+// RepositorySummary summarises a single repository
+type RepositorySummary struct {
+	Name   reference.Named
+	Images int
+}
+
+// Searcher is implemented by backends, which can search the images of a
+// repository themselves instead of having them scanned
+type Searcher interface {
+	// Search returns the images of a repository matching a query, newest
+	// first, or nil if the repository isn't indexed
+	Search(repositoryRef reference.Named, query *ImageQuery, offset int, limit int) (*SearchResult, error)
+}
+
+// ImageQuery selects the images created in a time range, which have all of
+// a set of labels. Zero times leave the range open.
+type ImageQuery struct {
+	Labels        map[string]string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// Matches reports whether an image matches the query
+func (q *ImageQuery) Matches(image *Image) bool {
+	if !q.CreatedAfter.IsZero() && q.CreatedAfter.After(image.Created) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && q.CreatedBefore.Before(image.Created) {
+		return false
+	}
+	for labelKey, labelValue := range q.Labels {
+		value, ok := image.Labels[labelKey]
+		if !ok || value != labelValue {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchResult is a page of the images matching a query
+type SearchResult struct {
+	Images []*Image
+	Count  int
+}
@@ -0,0 +1,366 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultBoltCacheSize is the default number of repositories BoltBackend
+// caches in memory
+const DefaultBoltCacheSize = 1000
+
+// boltRepositories is the bucket containing a bucket of images by tag for
+// each repository
+var boltRepositories = []byte("repositories")
+
+// BoltBackend is a Backend, which keeps the index on disk in a bbolt
+// database. Only the most recently used repositories are cached in memory,
+// so memory use scales with the working set instead of with the size of the
+// index. Every change is committed to disk, so the index isn't saved to a
+// StateStorage and needs no journal.
+type BoltBackend struct {
+	db        *bolt.DB
+	cache     *repositoryCache
+	mutations uint64
+
+	// writeMutex orders changes and the invalidation of their repositories
+	writeMutex sync.Mutex
+}
+
+// OpenBoltBackend opens or creates an index database, caching up to
+// cacheSize repositories in memory
+func OpenBoltBackend(path string, cacheSize int) (*BoltBackend, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error opening index database %s", path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltRepositories)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.WithStack(err)
+	}
+
+	return &BoltBackend{
+		db:    db,
+		cache: newRepositoryCache(cacheSize),
+	}, nil
+}
+
+// Repository returns a single repository, or nil if it isn't indexed
+func (b *BoltBackend) Repository(repositoryRef reference.Named) (*Repository, error) {
+	name := reference.TrimNamed(repositoryRef).String()
+	if repository := b.cache.get(name); repository != nil {
+		return repository, nil
+	}
+
+	generation := b.cache.currentGeneration()
+	var repository *Repository
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRepositories).Bucket([]byte(name))
+		if bucket == nil {
+			return nil
+		}
+		var err error
+		repository, err = readBoltRepository(reference.TrimNamed(repositoryRef), bucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if repository != nil {
+		b.cache.add(name, repository, generation)
+	}
+	return repository, nil
+}
+
+// Repositories returns a summary of all repositories sorted by name
+func (b *BoltBackend) Repositories() ([]*RepositorySummary, error) {
+	var summaries []*RepositorySummary
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return forEachBoltRepository(tx, nil, func(repositoryRef reference.Named, bucket *bolt.Bucket) error {
+			summaries = append(summaries, &RepositorySummary{
+				Name:   repositoryRef,
+				Images: bucket.Stats().KeyN,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
+
+// ForEachImage calls fn for each image in a read transaction, until fn
+// returns an error
+func (b *BoltBackend) ForEachImage(fn func(repositoryRef reference.Named, image *Image) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return forEachBoltRepository(tx, nil, func(repositoryRef reference.Named, bucket *bolt.Bucket) error {
+			return forEachBoltImage(repositoryRef, bucket, func(image *Image) error {
+				return fn(repositoryRef, image)
+			})
+		})
+	})
+}
+
+// ReplaceRepository atomically replaces a single repository
+func (b *BoltBackend) ReplaceRepository(repository *Repository) error {
+	return b.apply(&JournalEntry{
+		Operation:  JournalReplaceRepository,
+		Repository: repository.Name.String(),
+		Images:     repository.Images,
+	})
+}
+
+// ReplaceImage atomically replaces a single image
+func (b *BoltBackend) ReplaceImage(imageRef reference.NamedTagged, image *Image) error {
+	return b.apply(&JournalEntry{
+		Operation:  JournalUpsertImage,
+		Repository: reference.TrimNamed(imageRef).String(),
+		Image:      image,
+	})
+}
+
+// DeleteImage deletes an image from a repository
+func (b *BoltBackend) DeleteImage(imageRef reference.NamedTagged) error {
+	return b.apply(&JournalEntry{
+		Operation:  JournalDeleteImage,
+		Repository: reference.TrimNamed(imageRef).String(),
+		Tag:        imageRef.Tag(),
+	})
+}
+
+// DeleteDigest atomically deletes every image in a repository with a
+// manifest digest, and returns the deleted tags
+func (b *BoltBackend) DeleteDigest(repositoryRef reference.Named, dgst digest.Digest) ([]string, error) {
+	repositoryRef = reference.TrimNamed(repositoryRef)
+	var changes []*JournalEntry
+	err := b.update(func(tx *bolt.Tx) ([]*JournalEntry, error) {
+		bucket := tx.Bucket(boltRepositories).Bucket([]byte(repositoryRef.String()))
+		if bucket == nil {
+			return nil, nil
+		}
+		repository, err := readBoltRepository(repositoryRef, bucket)
+		if err != nil {
+			return nil, err
+		}
+		changes = deleteDigestChanges(repository, dgst)
+		for _, change := range changes {
+			if err := applyBoltChange(tx, change); err != nil {
+				return nil, err
+			}
+		}
+		return changes, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changedTags(changes), nil
+}
+
+// Mutations returns the number of times the index has been changed since
+// the database was opened
+func (b *BoltBackend) Mutations() uint64 {
+	return atomic.LoadUint64(&b.mutations)
+}
+
+// Close closes the database
+func (b *BoltBackend) Close() error {
+	return errors.WithStack(b.db.Close())
+}
+
+func (b *BoltBackend) domainRepositories(domain string) ([]reference.Named, error) {
+	var result []reference.Named
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return forEachBoltRepository(tx, []byte(domain+"/"), func(repositoryRef reference.Named, bucket *bolt.Bucket) error {
+			result = append(result, repositoryRef)
+			return nil
+		})
+	})
+	return result, err
+}
+
+func (b *BoltBackend) repositoryImages(repositoryRef reference.Named) (map[string]*Image, error) {
+	var result map[string]*Image
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		result, err = readBoltImages(tx, repositoryRef)
+		return err
+	})
+	return result, err
+}
+
+// reconcileRepository applies the changes to a single repository in its own
+// write transaction, so a reconciliation never holds the database for longer
+// than it takes to write one repository
+func (b *BoltBackend) reconcileRepository(repositoryRef reference.Named, baseline map[string]*Image, crawled *Repository, result *RegistryReconciliation) error {
+	return b.update(func(tx *bolt.Tx) ([]*JournalEntry, error) {
+		current, err := readBoltImages(tx, repositoryRef)
+		if err != nil {
+			return nil, err
+		}
+		changes := reconcileChanges(repositoryRef, baseline, current, crawled, result)
+		for _, change := range changes {
+			if err := applyBoltChange(tx, change); err != nil {
+				return nil, err
+			}
+		}
+		return changes, nil
+	})
+}
+
+// persist does nothing, as every change is committed to disk
+func (b *BoltBackend) persist(storage StateStorage) error {
+	return nil
+}
+
+// apply commits a single change
+func (b *BoltBackend) apply(change *JournalEntry) error {
+	return b.update(func(tx *bolt.Tx) ([]*JournalEntry, error) {
+		return []*JournalEntry{change}, applyBoltChange(tx, change)
+	})
+}
+
+// update commits the changes made by fn in a write transaction, and
+// invalidates the changed repositories in the cache
+func (b *BoltBackend) update(fn func(tx *bolt.Tx) ([]*JournalEntry, error)) error {
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+
+	var changes []*JournalEntry
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		changes, err = fn(tx)
+		return err
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	names := make([]string, 0, len(changes))
+	for _, change := range changes {
+		names = append(names, change.Repository)
+	}
+	b.cache.invalidate(names...)
+	atomic.AddUint64(&b.mutations, uint64(len(changes)))
+	return nil
+}
+
+// applyBoltChange applies a change in a write transaction
+func applyBoltChange(tx *bolt.Tx, change *JournalEntry) error {
+	repositories := tx.Bucket(boltRepositories)
+	name := []byte(change.Repository)
+
+	switch change.Operation {
+	case JournalUpsertImage:
+		bucket, err := repositories.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		return putBoltImage(bucket, change.Image)
+	case JournalDeleteImage:
+		if bucket := repositories.Bucket(name); bucket != nil {
+			return bucket.Delete([]byte(change.Tag))
+		}
+		return nil
+	case JournalReplaceRepository:
+		if err := repositories.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		bucket, err := repositories.CreateBucket(name)
+		if err != nil {
+			return err
+		}
+		for _, image := range change.Images {
+			if err := putBoltImage(bucket, image); err != nil {
+				return err
+			}
+		}
+		return nil
+	case JournalDeleteRepository:
+		if err := repositories.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	default:
+		return errors.Errorf("Unknown operation %q", change.Operation)
+	}
+}
+
+func putBoltImage(bucket *bolt.Bucket, image *Image) error {
+	value, err := json.Marshal(image)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(image.Tag), value)
+}
+
+// readBoltImages reads the images of a repository by tag, or returns nil if
+// it isn't indexed
+func readBoltImages(tx *bolt.Tx, repositoryRef reference.Named) (map[string]*Image, error) {
+	bucket := tx.Bucket(boltRepositories).Bucket([]byte(repositoryRef.String()))
+	if bucket == nil {
+		return nil, nil
+	}
+	images := make(map[string]*Image)
+	err := forEachBoltImage(repositoryRef, bucket, func(image *Image) error {
+		images[image.Tag] = image
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// readBoltRepository reads a repository from its bucket
+func readBoltRepository(repositoryRef reference.Named, bucket *bolt.Bucket) (*Repository, error) {
+	var images []*Image
+	err := forEachBoltImage(repositoryRef, bucket, func(image *Image) error {
+		images = append(images, image)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return RepositoryFromImages(repositoryRef, images...), nil
+}
+
+// forEachBoltRepository calls fn for the bucket of each repository, whose
+// name starts with prefix
+func forEachBoltRepository(tx *bolt.Tx, prefix []byte, fn func(repositoryRef reference.Named, bucket *bolt.Bucket) error) error {
+	repositories := tx.Bucket(boltRepositories)
+	cursor := repositories.Cursor()
+	for name, _ := cursor.Seek(prefix); name != nil && bytes.HasPrefix(name, prefix); name, _ = cursor.Next() {
+		repositoryRef, err := reference.ParseNamed(string(name))
+		if err != nil {
+			return errors.Wrapf(err, "Invalid repository %q in index database", name)
+		}
+		if err := fn(reference.TrimNamed(repositoryRef), repositories.Bucket(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachBoltImage calls fn for each image in the bucket of a repository
+func forEachBoltImage(repositoryRef reference.Named, bucket *bolt.Bucket, fn func(image *Image) error) error {
+	return bucket.ForEach(func(tag []byte, value []byte) error {
+		var image Image
+		if err := json.Unmarshal(value, &image); err != nil {
+			return errors.Wrapf(err, "Invalid image %s:%s in index database", repositoryRef, tag)
+		}
+		return fn(&image)
+	})
+}
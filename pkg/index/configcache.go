@@ -0,0 +1,101 @@
+package index
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ConfigCache is a content-addressed cache of parsed image configs.
+//
+// Images are cached by manifest digest, and as manifests are immutable a
+// cached image never goes stale. A tag only needs its configs fetched, if
+// the tag has moved to a manifest digest not already in the cache.
+type ConfigCache struct {
+	images map[digest.Digest]*Image
+	mutex  sync.RWMutex
+}
+
+// NewConfigCache creates a new empty ConfigCache
+func NewConfigCache() *ConfigCache {
+	return &ConfigCache{
+		images: make(map[digest.Digest]*Image),
+	}
+}
+
+// Get returns a copy of the cached image with a manifest digest, tagged
+// with tag. Get returns nil, if the digest isn't cached.
+func (c *ConfigCache) Get(dgst digest.Digest, tag string) *Image {
+	if c == nil {
+		return nil
+	}
+	c.mutex.RLock()
+	cached, ok := c.images[dgst]
+	c.mutex.RUnlock()
+	if !ok {
+		configCacheRequests.WithLabelValues("miss").Inc()
+		return nil
+	}
+	configCacheRequests.WithLabelValues("hit").Inc()
+
+	image := *cached
+	image.Tag = tag
+	return &image
+}
+
+// Add adds an image to the cache. Images without a manifest digest are ignored.
+func (c *ConfigCache) Add(image *Image) {
+	if c == nil || image.Digest == "" {
+		return
+	}
+	cached := *image
+	cached.Tag = ""
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.images[image.Digest] = &cached
+}
+
+// Retain removes all images from the cache, except those with the given
+// manifest digests
+func (c *ConfigCache) Retain(digests map[digest.Digest]struct{}) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for dgst := range c.images {
+		if _, ok := digests[dgst]; !ok {
+			delete(c.images, dgst)
+		}
+	}
+}
+
+// Len returns the number of images in the cache
+func (c *ConfigCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return len(c.images)
+}
+
+func (c *ConfigCache) MarshalJSON() ([]byte, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return json.Marshal(c.images)
+}
+
+func (c *ConfigCache) UnmarshalJSON(data []byte) error {
+	images := make(map[digest.Digest]*Image)
+	if err := json.Unmarshal(data, &images); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.images = images
+	return nil
+}
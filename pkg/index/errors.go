@@ -0,0 +1,42 @@
+package index
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+// FetchError describes a failure to fetch a single repository or image
+type FetchError struct {
+	// Repository is the repository which failed to fetch
+	Repository reference.Named
+
+	// Image is the image which failed to fetch, or nil if the tags of
+	// the whole repository could not be listed
+	Image reference.NamedTagged
+
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	if e.Image != nil {
+		return fmt.Sprintf("failed to fetch image %v: %v", e.Image, e.Err)
+	}
+	return fmt.Sprintf("failed to fetch repository %v: %v", e.Repository, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// FetchErrors aggregates the failures of a crawl
+type FetchErrors []*FetchError
+
+func (e FetchErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%d fetch errors: %s", len(e), strings.Join(messages, "; "))
+}
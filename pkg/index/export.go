@@ -0,0 +1,162 @@
+package index
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/parmus/registryindexer/internal/utils"
+	"github.com/pkg/errors"
+)
+
+// ExportFormat is a format of exported images
+type ExportFormat string
+
+const (
+	// ExportJSON is a JSON object of image lists by repository name, like the
+	// payload of a state file
+	ExportJSON ExportFormat = "json"
+
+	// ExportNDJSON is a line of JSON for each image
+	ExportNDJSON ExportFormat = "ndjson"
+)
+
+// ParseExportFormat parses the name of an export format
+func ParseExportFormat(name string) (ExportFormat, error) {
+	switch format := ExportFormat(name); format {
+	case ExportJSON, ExportNDJSON:
+		return format, nil
+	default:
+		return "", errors.Errorf("Unknown export format %q", name)
+	}
+}
+
+// ExportedImage is an image in the NDJSON export format
+type ExportedImage struct {
+	Repository string `json:"repository"`
+	Image      *Image `json:"image"`
+}
+
+// RepositoryFilter selects repositories by registry domain and by name
+// prefix. An empty list of registries or prefixes selects everything.
+type RepositoryFilter struct {
+	Registries []string
+	Prefixes   []string
+}
+
+// Matches reports whether the filter selects a repository
+func (f *RepositoryFilter) Matches(repositoryRef reference.Named) bool {
+	if len(f.Registries) > 0 && !containsString(f.Registries, reference.Domain(repositoryRef)) {
+		return false
+	}
+	return len(f.Prefixes) == 0 || utils.HasAnyPrefix(f.Prefixes, repositoryRef.Name())
+}
+
+// Export writes the images of the repositories selected by filter, and
+// returns the number of exported images. The images are streamed from the
+// backend, so the export isn't held in memory.
+func Export(w io.Writer, backend Backend, format ExportFormat, filter *RepositoryFilter) (int, error) {
+	writer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(writer)
+	var current reference.Named
+	exported := 0
+
+	if format == ExportJSON {
+		writer.WriteString("{")
+	}
+	err := backend.ForEachImage(func(repositoryRef reference.Named, image *Image) error {
+		if !filter.Matches(repositoryRef) {
+			return nil
+		}
+		exported++
+		if format == ExportNDJSON {
+			return encoder.Encode(&ExportedImage{
+				Repository: repositoryRef.String(),
+				Image:      image,
+			})
+		}
+
+		if current == nil || current.String() != repositoryRef.String() {
+			if current != nil {
+				writer.WriteString("],")
+			}
+			current = repositoryRef
+			name, err := json.Marshal(repositoryRef.String())
+			if err != nil {
+				return err
+			}
+			writer.Write(name)
+			writer.WriteString(":[")
+		} else {
+			writer.WriteString(",")
+		}
+		value, err := json.Marshal(image)
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(value)
+		return err
+	})
+	if err != nil {
+		return exported, errors.WithStack(err)
+	}
+	if format == ExportJSON {
+		if current != nil {
+			writer.WriteString("]")
+		}
+		writer.WriteString("}\n")
+	}
+	return exported, errors.WithStack(writer.Flush())
+}
+
+// Import reads images exported in format, and returns the repositories
+// selected by filter
+func Import(r io.Reader, format ExportFormat, filter *RepositoryFilter) (map[reference.Named]*Repository, error) {
+	imagesByName := make(map[string][]*Image)
+	switch format {
+	case ExportJSON:
+		if err := json.NewDecoder(r).Decode(&imagesByName); err != nil {
+			return nil, errors.Wrap(err, "Invalid JSON export")
+		}
+	case ExportNDJSON:
+		decoder := json.NewDecoder(r)
+		for line := 1; ; line++ {
+			var exported ExportedImage
+			if err := decoder.Decode(&exported); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, errors.Wrapf(err, "Invalid NDJSON export in line %d", line)
+			}
+			if exported.Image == nil {
+				return nil, errors.Errorf("Missing image in line %d", line)
+			}
+			imagesByName[exported.Repository] = append(imagesByName[exported.Repository], exported.Image)
+		}
+	default:
+		return nil, errors.Errorf("Unknown export format %q", format)
+	}
+
+	repositories := make(map[reference.Named]*Repository)
+	for name, images := range imagesByName {
+		repositoryRef, err := reference.ParseNamed(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid repository %q", name)
+		}
+		repositoryRef = reference.TrimNamed(repositoryRef)
+		if filter.Matches(repositoryRef) {
+			repositories[repositoryRef] = RepositoryFromImages(repositoryRef, images...)
+		}
+	}
+	return repositories, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
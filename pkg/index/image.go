@@ -1,28 +1,109 @@
 package index
 
 import (
+	"context"
 	"time"
 
 	"github.com/parmus/registryindexer/pkg/registry"
 	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
 )
 
 type Image struct {
-	Tag     string            `json:"tag"`
-	Created time.Time         `json:"created"`
-	Labels  map[string]string `json:"labels"`
+	Tag          string            `json:"tag"`
+	Digest       digest.Digest     `json:"digest,omitempty"`
+	ConfigDigest digest.Digest     `json:"config_digest,omitempty"`
+	Created      time.Time         `json:"created"`
+	Labels       map[string]string `json:"labels"`
+	Platforms    []*Platform       `json:"platforms,omitempty"`
 }
 
-// FetchImage fetch a single image from a repository in a registry
-func FetchImage(registry *registry.Registry, tag reference.NamedTagged) (*Image, error) {
-	image, err := registry.GetImageFromTag(tag)
+// Platform contains the config of an image for a single platform
+type Platform struct {
+	Digest       digest.Digest     `json:"digest,omitempty"`
+	ConfigDigest digest.Digest     `json:"config_digest,omitempty"`
+	OS           string            `json:"os"`
+	Architecture string            `json:"architecture"`
+	Variant      string            `json:"variant,omitempty"`
+	Created      time.Time         `json:"created"`
+	Labels       map[string]string `json:"labels"`
+}
+
+// FetchImage fetch a single image from a repository in a registry.
+// The tag is resolved to a manifest digest first, and the image configs are
+// only fetched if the digest isn't in the config cache.
+// For multi-platform images the image is created at the time of the newest
+// platform, and carries the labels and config digest of the first platform in
+// the image index.
+func FetchImage(ctx context.Context, registry *registry.Registry, cache *ConfigCache, tag reference.NamedTagged) (*Image, error) {
+	dgst, err := registry.GetTagDigest(ctx, tag)
 	if err != nil {
 		return nil, err
 	}
-	created, err := time.Parse(time.RFC3339Nano, image.Created)
+	if cached := cache.Get(dgst, tag.Tag()); cached != nil {
+		return cached, nil
+	}
+
+	canonical, err := reference.WithDigest(tag, dgst)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	image, err := registry.GetImageFromDigest(ctx, canonical)
 	if err != nil {
 		return nil, err
 	}
+	if len(image.Configs) == 0 {
+		return nil, errors.Errorf("%v does not contain any platforms", tag)
+	}
 
-	return &Image{tag.Tag(), created, image.Config.Labels}, nil
+	result := &Image{
+		Tag:       tag.Tag(),
+		Digest:    image.Digest,
+		Platforms: make([]*Platform, 0, len(image.Configs)),
+	}
+	for i, config := range image.Configs {
+		created, err := time.Parse(time.RFC3339Nano, config.Image.Created)
+		if err != nil {
+			return nil, err
+		}
+		var labels map[string]string
+		if config.Image.Config != nil {
+			labels = config.Image.Config.Labels
+		}
+
+		if i == 0 {
+			result.Labels = labels
+			result.ConfigDigest = config.ConfigDigest
+		}
+		if created.After(result.Created) {
+			result.Created = created
+		}
+		result.Platforms = append(result.Platforms, &Platform{
+			Digest:       config.ManifestDigest,
+			ConfigDigest: config.ConfigDigest,
+			OS:           config.OS,
+			Architecture: config.Architecture,
+			Variant:      config.Variant,
+			Created:      created,
+			Labels:       labels,
+		})
+	}
+
+	cache.Add(result)
+	return result, nil
+}
+
+// Digests returns the manifest digests of the image and each of its platforms
+func (i *Image) Digests() []digest.Digest {
+	digests := make([]digest.Digest, 0, len(i.Platforms)+1)
+	if i.Digest != "" {
+		digests = append(digests, i.Digest)
+	}
+	for _, platform := range i.Platforms {
+		if platform.Digest != "" && platform.Digest != i.Digest {
+			digests = append(digests, platform.Digest)
+		}
+	}
+	return digests
 }
@@ -2,15 +2,28 @@ package index
 
 import (
 	"encoding/json"
+	"log"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
 )
 
-// Index contains a index of a Docker registry
+// Index contains a index of a Docker registry in memory. It is the default
+// Backend.
+//
+// Repositories in the index are never modified. Changes replace a repository
+// with a modified copy, so readers can use repositories and snapshots of the
+// index without holding any lock.
+//
+// Changes are appended to the journal of the index, if it was loaded from a
+// StateStorage which keeps one.
 type Index struct {
+	mutations    uint64
 	repositories map[reference.Named]*Repository
+	journal      Journal
 	rwmutex      sync.RWMutex
 }
 
@@ -21,64 +34,213 @@ func NewIndex() *Index {
 	}
 }
 
-// Locker returns the read lock need to access the index thread-safely
-func (i *Index) Locker() sync.Locker {
-	return i.rwmutex.RLocker()
+// Snapshot returns an immutable point-in-time view of the index
+func (i *Index) Snapshot() *Snapshot {
+	i.rwmutex.RLock()
+	defer i.rwmutex.RUnlock()
+
+	repositories := make(map[reference.Named]*Repository, len(i.repositories))
+	for repositoryRef, repository := range i.repositories {
+		repositories[repositoryRef] = repository
+	}
+	return &Snapshot{
+		repositories: repositories,
+		mutations:    i.Mutations(),
+	}
+}
+
+// Mutations returns the number of times the index has been changed
+func (i *Index) Mutations() uint64 {
+	return atomic.LoadUint64(&i.mutations)
+}
+
+// mutated counts a change of the index
+func (i *Index) mutated() uint64 {
+	return atomic.AddUint64(&i.mutations, 1)
+}
+
+// record counts a change of the index, and appends it to the journal. The
+// index must be locked.
+func (i *Index) record(entry *JournalEntry) {
+	entry.Sequence = i.mutated()
+	if i.journal == nil {
+		return
+	}
+	if err := i.journal.Append(entry); err != nil {
+		journalFailures.Inc()
+		log.Printf("[index] Unable to journal %s of %s: %v", entry.Operation, entry.Repository, err)
+		return
+	}
+	journalEntries.Inc()
 }
 
-// ReplaceAllRepositories atomically replaces all repositories
+// replay applies the entries of a journal to the index, and continues the
+// mutation count from the last entry
+func (i *Index) replay(journal Journal) (int, error) {
+	i.rwmutex.Lock()
+	defer i.rwmutex.Unlock()
+
+	replayed := 0
+	owned := make(map[reference.Named]bool)
+	err := journal.Replay(func(entry *JournalEntry) error {
+		if err := entry.apply(i, owned); err != nil {
+			return err
+		}
+		if entry.Sequence > i.Mutations() {
+			atomic.StoreUint64(&i.mutations, entry.Sequence)
+		}
+		replayed++
+		return nil
+	})
+	return replayed, err
+}
+
+// ReplaceAllRepositories atomically replaces all repositories. The
+// repositories must not be modified once they are in the index. The
+// replacement is not journaled.
 func (i *Index) ReplaceAllRepositories(repositories map[reference.Named]*Repository) {
 	i.rwmutex.Lock()
 	defer i.rwmutex.Unlock()
 	i.repositories = repositories
+	i.mutated()
 }
 
-// ReplaceRepository atomically replaces a single repository
-func (i *Index) ReplaceRepository(repository *Repository) {
+// ReplaceRepository atomically replaces a single repository. The repository
+// must not be modified once it is in the index.
+func (i *Index) ReplaceRepository(repository *Repository) error {
 	i.rwmutex.Lock()
 	defer i.rwmutex.Unlock()
 	i.repositories[repository.Name] = repository
+	i.record(&JournalEntry{
+		Operation:  JournalReplaceRepository,
+		Repository: repository.Name.String(),
+		Images:     repository.Images,
+	})
+	return nil
 }
 
 // ReplaceImage atomically replaces a single image
-func (i *Index) ReplaceImage(imageRef reference.NamedTagged, image *Image) {
+func (i *Index) ReplaceImage(imageRef reference.NamedTagged, image *Image) error {
 	i.rwmutex.Lock()
 	defer i.rwmutex.Unlock()
 
-	if repository, ok := i.repositories[reference.TrimNamed(imageRef)]; ok {
-		repository.UpdateImage(image)
-	} else {
-		repository := RepositoryFromImages(imageRef, image)
-		i.repositories[repository.Name] = repository
-	}
+	repositoryRef := reference.TrimNamed(imageRef)
+	i.upsertImage(repositoryRef, image, nil)
+	i.record(&JournalEntry{
+		Operation:  JournalUpsertImage,
+		Repository: repositoryRef.String(),
+		Image:      image,
+	})
+	return nil
 }
 
 // DeleteImage deletes an image from a repository
-func (i *Index) DeleteImage(imageRef reference.NamedTagged) {
+func (i *Index) DeleteImage(imageRef reference.NamedTagged) error {
 	i.rwmutex.Lock()
 	defer i.rwmutex.Unlock()
-	if repository, ok := i.repositories[reference.TrimNamed(imageRef)]; ok {
-		repository.DeleteImage(imageRef)
+
+	repositoryRef := reference.TrimNamed(imageRef)
+	if i.deleteTag(repositoryRef, imageRef.Tag(), nil) {
+		i.record(&JournalEntry{
+			Operation:  JournalDeleteImage,
+			Repository: repositoryRef.String(),
+			Tag:        imageRef.Tag(),
+		})
 	}
+	return nil
 }
 
-// Repositories returns a list of all the repository names
-func (i *Index) Repositories() []reference.Named {
-	var result = make([]reference.Named, 0, len(i.repositories))
-	for key := range i.repositories {
-		result = append(result, key)
+// DeleteDigest atomically deletes every image in a repository with a
+// manifest digest, and returns the deleted tags
+func (i *Index) DeleteDigest(repositoryRef reference.Named, dgst digest.Digest) ([]string, error) {
+	i.rwmutex.Lock()
+	defer i.rwmutex.Unlock()
+
+	repositoryRef = reference.TrimNamed(repositoryRef)
+	repository, ok := i.repositories[repositoryRef]
+	if !ok {
+		return nil, nil
 	}
-	sort.Sort(referenceList(result))
-	return result
+	changes := deleteDigestChanges(repository, dgst)
+	owned := make(map[reference.Named]bool)
+	for _, change := range changes {
+		i.deleteTag(repositoryRef, change.Tag, owned)
+		i.record(change)
+	}
+	return changedTags(changes), nil
+}
+
+// mutableRepository returns a repository, which can be modified in place. The
+// repository is cloned, unless it is in owned, and the clone is added to
+// owned. The index must be locked.
+func (i *Index) mutableRepository(repositoryRef reference.Named, owned map[reference.Named]bool) *Repository {
+	repository, ok := i.repositories[repositoryRef]
+	if !ok {
+		return nil
+	}
+	if !owned[repositoryRef] {
+		repository = repository.clone()
+		i.repositories[repositoryRef] = repository
+		if owned != nil {
+			owned[repositoryRef] = true
+		}
+	}
+	return repository
+}
+
+// upsertImage adds or replaces an image in a repository. The index must be
+// locked.
+func (i *Index) upsertImage(repositoryRef reference.Named, image *Image, owned map[reference.Named]bool) {
+	if repository := i.mutableRepository(repositoryRef, owned); repository != nil {
+		repository.UpdateImage(image)
+	} else {
+		i.repositories[repositoryRef] = RepositoryFromImages(repositoryRef, image)
+	}
+}
+
+// deleteTag deletes an image from a repository by tag, and reports whether
+// the repository exists. The index must be locked.
+func (i *Index) deleteTag(repositoryRef reference.Named, tag string, owned map[reference.Named]bool) bool {
+	repository := i.mutableRepository(repositoryRef, owned)
+	if repository == nil {
+		return false
+	}
+	repository.deleteTag(tag)
+	return true
+}
+
+// Repositories returns a summary of all repositories sorted by name
+func (i *Index) Repositories() ([]*RepositorySummary, error) {
+	return i.Snapshot().Summaries(), nil
+}
+
+// ForEachImage calls fn for each image in a snapshot of the index, until fn
+// returns an error
+func (i *Index) ForEachImage(fn func(repositoryRef reference.Named, image *Image) error) error {
+	snapshot := i.Snapshot()
+	for _, repositoryRef := range snapshot.Repositories() {
+		for _, image := range snapshot.Repository(repositoryRef).Images {
+			if err := fn(repositoryRef, image); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close does nothing, as the index is kept in memory
+func (i *Index) Close() error {
+	return nil
+}
+
+// persist saves the index to a StateStorage
+func (i *Index) persist(storage StateStorage) error {
+	return storage.SaveIndex(i)
 }
 
 // MarshalJSON handles JSON serialization of an Index
 func (i *Index) MarshalJSON() ([]byte, error) {
-	out := make(map[string]*([]*Image))
-	for repositoryRef, repository := range i.repositories {
-		out[repositoryRef.String()] = &repository.Images
-	}
-	return json.Marshal(out)
+	return i.Snapshot().MarshalJSON()
 }
 
 // UnmarshalJSON handles JSON deserialization of an Index
@@ -101,7 +263,74 @@ func (i *Index) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// Repository returns a single repository, or nil if it isn't indexed
+func (i *Index) Repository(repositoryRef reference.Named) (*Repository, error) {
+	i.rwmutex.RLock()
+	defer i.rwmutex.RUnlock()
+	return i.repositories[reference.TrimNamed(repositoryRef)], nil
+}
+
+// Snapshot is an immutable point-in-time view of an Index
+type Snapshot struct {
+	repositories map[reference.Named]*Repository
+	mutations    uint64
+}
+
+// Repositories returns a list of all the repository names
+func (s *Snapshot) Repositories() []reference.Named {
+	var result = make([]reference.Named, 0, len(s.repositories))
+	for key := range s.repositories {
+		result = append(result, key)
+	}
+	sort.Sort(referenceList(result))
+	return result
+}
+
 // Repository returns a single repository
-func (i *Index) Repository(repositoryRef reference.Named) *Repository {
-	return i.repositories[reference.TrimNamed(repositoryRef)]
+func (s *Snapshot) Repository(repositoryRef reference.Named) *Repository {
+	return s.repositories[reference.TrimNamed(repositoryRef)]
+}
+
+// Summaries returns a summary of all repositories sorted by name
+func (s *Snapshot) Summaries() []*RepositorySummary {
+	repositoryRefs := s.Repositories()
+	summaries := make([]*RepositorySummary, 0, len(repositoryRefs))
+	for _, repositoryRef := range repositoryRefs {
+		summaries = append(summaries, &RepositorySummary{
+			Name:   repositoryRef,
+			Images: len(s.repositories[repositoryRef].Images),
+		})
+	}
+	return summaries
+}
+
+// Mutations returns the number of times the index had been changed, when
+// the snapshot was taken
+func (s *Snapshot) Mutations() uint64 {
+	return s.mutations
+}
+
+// Registries returns the sorted domains of all registries in the snapshot
+func (s *Snapshot) Registries() []string {
+	seen := make(map[string]struct{})
+	registries := make([]string, 0)
+	for repositoryRef := range s.repositories {
+		domain := reference.Domain(repositoryRef)
+		if _, ok := seen[domain]; !ok {
+			seen[domain] = struct{}{}
+			registries = append(registries, domain)
+		}
+	}
+	sort.Strings(registries)
+	return registries
+}
+
+// MarshalJSON handles JSON serialization of a Snapshot in the same format
+// as an Index
+func (s *Snapshot) MarshalJSON() ([]byte, error) {
+	out := make(map[string][]*Image)
+	for repositoryRef, repository := range s.repositories {
+		out[repositoryRef.String()] = repository.Images
+	}
+	return json.Marshal(out)
 }
@@ -3,32 +3,46 @@ package index
 import (
 	"context"
 	"log"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/parmus/registryindexer/internal/notifications"
 	"github.com/parmus/registryindexer/pkg/registry"
 	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
 type Indexer struct {
 	registryByHost map[string]*registry.Registry
-	index          *Index
+	index          Backend
 	actionQueue    chan notifications.Action
+	retries        *retrySet
+	pool           *WorkerPool
+	cache          *ConfigCache
+
+	reconciliations     map[string]*RegistryReconciliation
+	reconciliationMutex sync.RWMutex
 }
 
-// NewIndexer creates a new Indexer
-func NewIndexer(index *Index, actionQueueLength uint64, registries ...*registry.Registry) (*Indexer, error) {
+// NewIndexer creates a new Indexer, which crawls registries in the worker pool,
+// and only fetches the configs of images not already in the config cache
+func NewIndexer(index Backend, cache *ConfigCache, actionQueueLength uint64, pool *WorkerPool, registries ...*registry.Registry) (*Indexer, error) {
 	registryByHost := make(map[string]*registry.Registry)
 	for _, registry := range registries {
-		registryByHost[registry.Hostname()] = registry
+		registryByHost[registry.Domain()] = registry
 	}
 
 	return &Indexer{
 		registryByHost: registryByHost,
 		index:          index,
 		actionQueue:    make(chan notifications.Action, actionQueueLength),
+		retries:        newRetrySet(),
+		pool:           pool,
+		cache:          cache,
+
+		reconciliations: make(map[string]*RegistryReconciliation),
 	}, nil
 }
 
@@ -37,56 +51,370 @@ func (i *Indexer) ActionQueue() notifications.ActionQueue {
 	return i.actionQueue
 }
 
-// IndexAll performs a complete reindexing
-func (i *Indexer) IndexAll() error {
-	allRepositories := make(map[reference.Named]*Repository)
+// RetryCount returns the number of repositories and images waiting to be retried
+func (i *Indexer) RetryCount() int {
+	return i.retries.Len()
+}
+
+// IndexAll performs a complete reindexing, reconciling the index with each
+// registry in turn. Only the added, changed and removed repositories and tags
+// of a registry are applied to the index, and tags changed by notifications
+// while the registry is crawled are left untouched. A registry which fails
+// to crawl is left unchanged in the index. Repositories and images, which
+// fail to fetch, keep their currently indexed content and are scheduled for
+// retry. If the context is cancelled, IndexAll is aborted and registries not
+// yet reconciled are left unchanged.
+func (i *Indexer) IndexAll(ctx context.Context) error {
+	return i.reconcile(ctx, false, i.registries()...)
+}
+
+// IndexRegistry reconciles the index with a single registry like IndexAll
+func (i *Indexer) IndexRegistry(ctx context.Context, domain string) error {
+	registry := i.registryByHost[domain]
+	if registry == nil {
+		return errors.Errorf("Failed to index %v: no such registry configured", domain)
+	}
+	return i.reconcile(ctx, false, registry)
+}
+
+// LastReconciliation returns a summary of the last reconciliation of each
+// registry, which has been reconciled
+func (i *Indexer) LastReconciliation() *Reconciliation {
+	i.reconciliationMutex.RLock()
+	defer i.reconciliationMutex.RUnlock()
+
+	reconciliation := &Reconciliation{
+		Registries: make([]*RegistryReconciliation, 0, len(i.reconciliations)),
+	}
+	for _, result := range i.reconciliations {
+		reconciliation.Registries = append(reconciliation.Registries, result)
+	}
+	sort.Slice(reconciliation.Registries, func(a, b int) bool {
+		return reconciliation.Registries[a].Registry < reconciliation.Registries[b].Registry
+	})
+	return reconciliation
+}
+
+// registries returns all configured registries
+func (i *Indexer) registries() []*registry.Registry {
+	registries := make([]*registry.Registry, 0, len(i.registryByHost))
 	for _, registry := range i.registryByHost {
-		repositories, err := FetchRepositories(registry)
+		registries = append(registries, registry)
+	}
+	return registries
+}
+
+// reconcile reconciles the index with a number of registries. Scheduled
+// reconciliations report drift. An error is only returned if the context is
+// cancelled.
+func (i *Indexer) reconcile(ctx context.Context, scheduled bool, registries ...*registry.Registry) error {
+	for _, registry := range registries {
+		result, err := i.reconcileRegistry(ctx, scheduled, registry)
 		if err != nil {
 			return err
 		}
-		for key, value := range repositories {
-			allRepositories[key] = value
-		}
+
+		i.reconciliationMutex.Lock()
+		i.reconciliations[result.Registry] = result
+		i.reconciliationMutex.Unlock()
 	}
 
-	i.index.ReplaceAllRepositories(allRepositories)
+	i.retainCachedConfigs()
 	return nil
 }
 
-// IndexRepository performs a reindexing of a single repository
-func (i *Indexer) IndexRepository(repositoryRef reference.Named) error {
+// reconcileRegistry crawls a registry and applies the changes to the index.
+// An error is only returned if the context is cancelled.
+func (i *Indexer) reconcileRegistry(ctx context.Context, scheduled bool, registry *registry.Registry) (*RegistryReconciliation, error) {
+	result := &RegistryReconciliation{
+		Registry:  registry.Domain(),
+		Scheduled: scheduled,
+		Started:   time.Now(),
+	}
+	if err := i.crawlRegistry(ctx, registry, result); err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		result.Error = err.Error()
+	}
+	result.Finished = time.Now()
+
+	log.Printf("[indexer] Reconciled %v", result)
+	result.observe()
+	return result, nil
+}
+
+// crawlRegistry crawls a registry and reconciles the index with it one
+// repository at a time. The baseline of each repository is taken when its
+// crawl starts, and only up to the number of workers per registry
+// repositories are crawled at once, so a reconciliation never holds more
+// than those in memory.
+func (i *Indexer) crawlRegistry(ctx context.Context, registry *registry.Registry, result *RegistryReconciliation) error {
+	// Repositories indexed during the crawl are newer than the catalog, so
+	// only those indexed before it was fetched can be gone from the registry
+	indexed, err := i.index.domainRepositories(registry.Domain())
+	if err != nil {
+		return err
+	}
+	catalog, err := registry.GetCatalog(ctx)
+	if err != nil {
+		return err
+	}
+
+	inCatalog := make(map[string]bool, len(catalog))
+	for _, repositoryRef := range catalog {
+		inCatalog[reference.TrimNamed(repositoryRef).String()] = true
+	}
+	for _, repositoryRef := range indexed {
+		if inCatalog[repositoryRef.String()] {
+			continue
+		}
+		if err := i.reconcileGoneRepository(repositoryRef, result); err != nil {
+			return err
+		}
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var crawlErr error
+	slots := make(chan struct{}, i.pool.workersPerRegistry)
+	for _, repositoryRef := range catalog {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		}
+
+		repositoryRef := reference.TrimNamed(repositoryRef)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := i.crawlRepository(ctx, registry, repositoryRef, &mutex, result); err != nil {
+				mutex.Lock()
+				defer mutex.Unlock()
+				if crawlErr == nil {
+					crawlErr = err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return crawlErr
+}
+
+// crawlRepository crawls a single repository of a registry, and reconciles
+// the index with it. mutex guards result.
+func (i *Indexer) crawlRepository(ctx context.Context, registry *registry.Registry, repositoryRef reference.Named, mutex *sync.Mutex, result *RegistryReconciliation) error {
+	baseline, err := i.index.repositoryImages(repositoryRef)
+	if err != nil {
+		return err
+	}
+	repository, errs, err := FetchRepository(ctx, i.pool, i.cache, registry, repositoryRef)
+	if err != nil {
+		return err
+	}
+	i.handleFetchErrors(errs)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	result.FetchErrors += len(errs)
+	if repository == nil {
+		// The tag list failed, so the repository is left as indexed
+		return nil
+	}
+	repositories := map[reference.Named]*Repository{repository.Name: repository}
+	if err := i.keepIndexed(repositories, errs); err != nil {
+		return err
+	}
+	return i.index.reconcileRepository(repositoryRef, baseline, repository, result)
+}
+
+// reconcileGoneRepository removes the tags of a repository, which is gone
+// from the catalog of its registry
+func (i *Indexer) reconcileGoneRepository(repositoryRef reference.Named, result *RegistryReconciliation) error {
+	baseline, err := i.index.repositoryImages(repositoryRef)
+	if err != nil {
+		return err
+	}
+	return i.index.reconcileRepository(repositoryRef, baseline, nil, result)
+}
+
+// IndexRepository performs a reindexing of a single repository. Images,
+// which fail to fetch, keep their currently indexed content and are
+// scheduled for retry.
+func (i *Indexer) IndexRepository(ctx context.Context, repositoryRef reference.Named) error {
 	registry := i.registryByHost[reference.Domain(repositoryRef)]
 	if registry == nil {
 		return errors.Errorf("Failed to index %v: no such registry configured", repositoryRef)
 	}
-	repository, err := FetchRepository(registry, repositoryRef)
+	repository, errs, err := FetchRepository(ctx, i.pool, i.cache, registry, repositoryRef)
 	if err != nil {
 		return err
 	}
+	i.handleFetchErrors(errs)
+	if repository == nil {
+		return nil
+	}
 
-	i.index.ReplaceRepository(repository)
-	return nil
+	repositories := map[reference.Named]*Repository{repository.Name: repository}
+	if err := i.keepIndexed(repositories, errs); err != nil {
+		return err
+	}
+	return i.index.ReplaceRepository(repositories[repository.Name])
 }
 
 // IndexImage reindexes a single image
-func (i *Indexer) IndexImage(imageRef reference.NamedTagged) error {
+func (i *Indexer) IndexImage(ctx context.Context, imageRef reference.NamedTagged) error {
 	registry := i.registryByHost[reference.Domain(imageRef)]
 	if registry == nil {
 		return errors.Errorf("Failed to index %v: no such registry configured", imageRef)
 	}
-	image, err := FetchImage(registry, imageRef)
+	image, err := FetchImage(ctx, registry, i.cache, imageRef)
 	if err != nil {
 		return err
 	}
 
-	i.index.ReplaceImage(imageRef, image)
-	return nil
+	return i.index.ReplaceImage(imageRef, image)
 }
 
 // DeleteImage deletes an image from a repository
-func (i *Indexer) DeleteImage(imageRef reference.NamedTagged) {
-	i.index.DeleteImage(imageRef)
+func (i *Indexer) DeleteImage(imageRef reference.NamedTagged) error {
+	return i.index.DeleteImage(imageRef)
+}
+
+// IndexDigest reindexes the tags of a repository, which resolve to a manifest
+// digest, or whose indexed image has it or has a platform with it. Every tag
+// of the repository is resolved, so the tags of a freshly pushed digest are
+// found too. A repository, which isn't indexed yet, is indexed as a whole.
+func (i *Indexer) IndexDigest(ctx context.Context, repositoryRef reference.Named, dgst digest.Digest) error {
+	registry := i.registryByHost[reference.Domain(repositoryRef)]
+	if registry == nil {
+		return errors.Errorf("Failed to index %v@%v: no such registry configured", repositoryRef, dgst)
+	}
+	repository, err := i.index.Repository(repositoryRef)
+	if err != nil {
+		return err
+	}
+	if repository == nil {
+		return i.IndexRepository(ctx, repositoryRef)
+	}
+	tags, err := registry.GetTags(ctx, repository.Name)
+	if err != nil {
+		return err
+	}
+
+	indexed := make(map[string]bool)
+	for _, image := range repository.GetImagesByDigest(dgst) {
+		indexed[image.Tag] = true
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var errs FetchErrors
+	for _, tag := range tags {
+		tag := tag
+		err := i.pool.Go(ctx, registry.Hostname(), &wg, func() {
+			if !indexed[tag.Tag()] {
+				tagDigest, err := registry.GetTagDigest(ctx, tag)
+				if err == nil && tagDigest != dgst {
+					return
+				}
+			}
+			if err := i.IndexImage(ctx, tag); err != nil {
+				mutex.Lock()
+				defer mutex.Unlock()
+				errs = append(errs, &FetchError{Repository: repository.Name, Image: tag, Err: err})
+			}
+		})
+		if err != nil {
+			wg.Wait()
+			return err
+		}
+	}
+	wg.Wait()
+	i.handleFetchErrors(errs)
+	return nil
+}
+
+// DeleteDigest deletes the images in a repository with a manifest digest
+func (i *Indexer) DeleteDigest(repositoryRef reference.Named, dgst digest.Digest) ([]string, error) {
+	return i.index.DeleteDigest(repositoryRef, dgst)
+}
+
+// IndexedTags returns the manifest digest of each indexed tag of a repository
+func (i *Indexer) IndexedTags(repositoryRef reference.Named) (map[string]digest.Digest, error) {
+	repository, err := i.index.Repository(repositoryRef)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]digest.Digest)
+	if repository != nil {
+		for _, image := range repository.Images {
+			tags[image.Tag] = image.Digest
+		}
+	}
+	return tags, nil
+}
+
+// handleFetchErrors logs and counts fetch errors, and schedules the failed
+// repositories and images for retry
+func (i *Indexer) handleFetchErrors(errs FetchErrors) {
+	for _, err := range errs {
+		kind := "repository"
+		if err.Image != nil {
+			kind = "image"
+		}
+		log.Printf("[indexer] Scheduling retry: %v", err)
+		fetchErrors.WithLabelValues(reference.Domain(err.Repository), kind).Inc()
+	}
+	i.retries.AddFetchErrors(errs)
+}
+
+// keepIndexed copies the currently indexed content of failed repositories
+// and images into a set of freshly fetched repositories, so a failed fetch
+// doesn't remove anything from the index
+func (i *Indexer) keepIndexed(repositories map[reference.Named]*Repository, errs FetchErrors) error {
+	for _, err := range errs {
+		indexed, readErr := i.index.Repository(err.Repository)
+		if readErr != nil {
+			return readErr
+		}
+		if indexed == nil {
+			continue
+		}
+		if err.Image == nil {
+			repositories[indexed.Name] = indexed
+			continue
+		}
+		image := indexed.GetImage(err.Image)
+		repository, ok := repositories[indexed.Name]
+		if image == nil || !ok {
+			continue
+		}
+		repository.UpdateImage(image)
+	}
+	return nil
+}
+
+// retainCachedConfigs evicts all images from the config cache, which aren't
+// in the index
+func (i *Indexer) retainCachedConfigs() {
+	digests := make(map[digest.Digest]struct{})
+	err := i.index.ForEachImage(func(repositoryRef reference.Named, image *Image) error {
+		digests[image.Digest] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[indexer] Unable to prune config cache: %v", err)
+		return
+	}
+
+	i.cache.Retain(digests)
 }
 
 // Serve starts serving the action queue
@@ -95,24 +423,32 @@ func (i *Indexer) Serve(ctx context.Context, wg *sync.WaitGroup) {
 	go func() {
 		defer wg.Done()
 
-		taintedImages := make([]reference.NamedTagged, 0)
-
 		for {
 			select {
 			case action := <-i.actionQueue:
 				switch action.Type {
 				case notifications.IndexAllAction:
-					log.Printf("[indexer] Reindexing all registries")
-					if err := i.IndexAll(); err != nil {
+					log.Printf("[indexer] Reconciling all registries")
+					if err := i.reconcile(ctx, true, i.registries()...); err != nil {
 						log.Printf("Unable to reindex registry: %v", err)
 					}
+				case notifications.IndexRegistryAction:
+					registry, ok := i.registryByHost[action.Registry]
+					if !ok {
+						log.Printf("[indexer] Skipping %v; registry not configured", action.Registry)
+						continue
+					}
+					log.Printf("[indexer] Reconciling %v", action.Registry)
+					if err := i.reconcile(ctx, true, registry); err != nil {
+						log.Printf("Unable to reindex registry %v: %v", action.Registry, err)
+					}
 				case notifications.IndexRepositoryAction:
 					if _, ok := i.registryByHost[reference.Domain(action.Repository)]; !ok {
 						log.Printf("[indexer] Skipping %v; registry not configured", action.Repository)
 						continue
 					}
 					log.Printf("[indexer] Reindexing %v", action.Repository)
-					if err := i.IndexRepository(action.Repository); err != nil {
+					if err := i.IndexRepository(ctx, action.Repository); err != nil {
 						log.Printf("Unable to reindex repository %v: %v", action.Repository, err)
 					}
 				case notifications.IndexImageAction:
@@ -121,27 +457,48 @@ func (i *Indexer) Serve(ctx context.Context, wg *sync.WaitGroup) {
 						continue
 					}
 					log.Printf("[indexer] Reindexing %v", action.Image)
-					if err := i.IndexImage(action.Image); err != nil {
-						log.Printf("Unable to reindex image %v: %v", action.Image, err)
-						taintedImages = append(taintedImages, action.Image)
+					if err := i.IndexImage(ctx, action.Image); err != nil {
+						i.handleFetchErrors(FetchErrors{{Repository: reference.TrimNamed(action.Image), Image: action.Image, Err: err}})
 					}
 				case notifications.DeleteImageAction:
 					log.Printf("[indexer] Deleting %v", action.Image)
-					i.DeleteImage(action.Image)
+					if err := i.DeleteImage(action.Image); err != nil {
+						log.Printf("[indexer] Unable to delete image %v: %v", action.Image, err)
+					}
+				case notifications.IndexDigestAction:
+					if _, ok := i.registryByHost[reference.Domain(action.Repository)]; !ok {
+						log.Printf("[indexer] Skipping %v; registry not configured", action.Repository)
+						continue
+					}
+					log.Printf("[indexer] Reindexing tags of %v@%v", action.Repository, action.Digest)
+					if err := i.IndexDigest(ctx, action.Repository, action.Digest); err != nil {
+						log.Printf("[indexer] Unable to reindex tags of %v@%v: %v", action.Repository, action.Digest, err)
+					}
+				case notifications.DeleteDigestAction:
+					tags, err := i.DeleteDigest(action.Repository, action.Digest)
+					if err != nil {
+						log.Printf("[indexer] Unable to delete tags of %v@%v: %v", action.Repository, action.Digest, err)
+						continue
+					}
+					log.Printf("[indexer] Deleted %v@%v tagged %v", action.Repository, action.Digest, tags)
 				}
 			case <-time.After(10 * time.Second):
-				if len(taintedImages) > 0 {
-					stillTainted := make([]reference.NamedTagged, 0)
-					for _, image := range taintedImages {
+				if i.retries.Len() > 0 {
+					repositories, images := i.retries.Take()
+					for _, repository := range repositories {
+						log.Printf("[indexer][retry] Reindexing %v", repository)
+						if err := i.IndexRepository(ctx, repository); err != nil {
+							log.Printf("Unable to reindex repository %v: %+v", repository, err)
+						}
+					}
+					for _, image := range images {
 						log.Printf("[indexer][retry] Reindexing %v", image)
-						if err := i.IndexImage(image); err != nil {
-							log.Printf("Unable to reindex image %v: %+v", image, err)
-							stillTainted = append(stillTainted, image)
+						if err := i.IndexImage(ctx, image); err != nil {
+							i.handleFetchErrors(FetchErrors{{Repository: reference.TrimNamed(image), Image: image, Err: err}})
 						}
 					}
-					taintedImages = stillTainted
-					if len(taintedImages) > 0 {
-						log.Printf("[Indexer] %v tainted images remains", len(taintedImages))
+					if remaining := i.retries.Len(); remaining > 0 {
+						log.Printf("[Indexer] %v tainted repositories and images remains", remaining)
 					}
 				}
 			case <-ctx.Done():
@@ -0,0 +1,182 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/parmus/registryindexer/pkg/registry"
+)
+
+// testRegistry is a registry serving OCI images from memory
+type testRegistry struct {
+	blobs map[digest.Digest][]byte
+	tags  map[string]map[string]digest.Digest
+	mutex sync.Mutex
+}
+
+// newTestRegistry starts a testRegistry, and returns a client of it
+func newTestRegistry(t *testing.T) (*testRegistry, *registry.Registry) {
+	r := &testRegistry{
+		blobs: make(map[digest.Digest][]byte),
+		tags:  make(map[string]map[string]digest.Digest),
+	}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	baseURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := registry.NewRegistry(baseURL, nil, nil, registry.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, client
+}
+
+// push pushes an image created at a time, and tags it in a repository
+func (r *testRegistry) push(t *testing.T, repository string, created time.Time, tags ...string) digest.Digest {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	config := r.put(t, map[string]interface{}{
+		"created":      created.Format(time.RFC3339Nano),
+		"architecture": "amd64",
+		"os":           "linux",
+	})
+	manifest := r.put(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageManifest,
+		"config":        v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: config, Size: int64(len(r.blobs[config]))},
+		"layers":        []v1.Descriptor{},
+	})
+	if r.tags[repository] == nil {
+		r.tags[repository] = make(map[string]digest.Digest)
+	}
+	for _, tag := range tags {
+		r.tags[repository][tag] = manifest
+	}
+	return manifest
+}
+
+// put stores a JSON blob, and returns its digest
+func (r *testRegistry) put(t *testing.T, value interface{}) digest.Digest {
+	blob, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromBytes(blob)
+	r.blobs[dgst] = blob
+	return dgst
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case req.URL.Path == "/v2/":
+	case path == "_catalog":
+		repositories := make([]string, 0, len(r.tags))
+		for repository := range r.tags {
+			repositories = append(repositories, repository)
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"repositories": repositories})
+	case strings.HasSuffix(path, "/tags/list"):
+		repository := strings.TrimSuffix(path, "/tags/list")
+		tags := make([]string, 0, len(r.tags[repository]))
+		for tag := range r.tags[repository] {
+			tags = append(tags, tag)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": tags})
+	case strings.Contains(path, "/manifests/"):
+		i := strings.Index(path, "/manifests/")
+		repository, ref := path[:i], path[i+len("/manifests/"):]
+		dgst, err := digest.Parse(ref)
+		if err != nil {
+			dgst = r.tags[repository][ref]
+		}
+		manifest, ok := r.blobs[dgst]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Content-Type", v1.MediaTypeImageManifest)
+		if req.Method != http.MethodHead {
+			w.Write(manifest)
+		}
+	case strings.Contains(path, "/blobs/"):
+		blob, ok := r.blobs[digest.Digest(path[strings.Index(path, "/blobs/")+len("/blobs/"):])]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(blob)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// indexedDigests returns the manifest digest of each indexed tag of a
+// repository
+func indexedDigests(t *testing.T, indexer *Indexer, repositoryRef reference.Named) map[string]digest.Digest {
+	tags, err := indexer.IndexedTags(repositoryRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tags
+}
+
+func TestIndexDigestOfNewDigest(t *testing.T) {
+	testRegistry, client := newTestRegistry(t)
+	first := testRegistry.push(t, "team/app", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "v1", "latest")
+
+	indexer, err := NewIndexer(NewIndex(), NewConfigCache(), 10, NewWorkerPool(0, 0), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := indexer.IndexAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A digest unknown to the index is pushed, and moves latest
+	repositoryRef, err := reference.ParseNamed(client.Domain() + "/team/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := testRegistry.push(t, "team/app", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), "v2", "latest")
+	if err := indexer.IndexDigest(ctx, repositoryRef, second); err != nil {
+		t.Fatalf("IndexDigest() error = %v", err)
+	}
+	want := map[string]digest.Digest{"v1": first, "v2": second, "latest": second}
+	if got := indexedDigests(t, indexer, repositoryRef); len(got) != len(want) || got["v1"] != first || got["v2"] != second || got["latest"] != second {
+		t.Errorf("indexed tags = %v, want %v", got, want)
+	}
+
+	// A digest pushed to a repository, which isn't indexed, indexes it
+	newRef, err := reference.ParseNamed(client.Domain() + "/team/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	third := testRegistry.push(t, "team/new", time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), "v1")
+	if err := indexer.IndexDigest(ctx, newRef, third); err != nil {
+		t.Fatalf("IndexDigest() error = %v", err)
+	}
+	if got := indexedDigests(t, indexer, newRef); len(got) != 1 || got["v1"] != third {
+		t.Errorf("indexed tags of the new repository = %v, want v1 at %v", got, third)
+	}
+}
@@ -0,0 +1,394 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+)
+
+// journalSuffix is appended to the state location to get the location of
+// the journal
+const journalSuffix = ".journal"
+
+// JournalOperation is the type of an index mutation in the journal
+type JournalOperation string
+
+const (
+	JournalUpsertImage       JournalOperation = "upsert-image"
+	JournalDeleteImage       JournalOperation = "delete-image"
+	JournalReplaceRepository JournalOperation = "replace-repository"
+	JournalDeleteRepository  JournalOperation = "delete-repository"
+)
+
+// JournalEntry is a single index mutation in the journal. The sequence is
+// the mutation count of the index after the mutation.
+type JournalEntry struct {
+	Sequence   uint64           `json:"seq"`
+	Operation  JournalOperation `json:"op"`
+	Repository string           `json:"repository"`
+	Tag        string           `json:"tag,omitempty"`
+	Image      *Image           `json:"image,omitempty"`
+	Images     []*Image         `json:"images,omitempty"`
+}
+
+// Journal is an append-only log of the mutations of an index since the last
+// snapshot of the state. Replaying the journal over the last snapshot
+// recovers the index after a crash.
+type Journal interface {
+	// Append appends an entry to the journal
+	Append(*JournalEntry) error
+
+	// Replay calls apply for each entry in the journal in order
+	Replay(apply func(*JournalEntry) error) error
+
+	// Compact removes all entries up to and including a sequence, as they
+	// are contained in a snapshot
+	Compact(sequence uint64) error
+}
+
+// apply applies the mutation of the entry to an index, which must be locked.
+// Repositories in owned were cloned by earlier entries of the same batch, and
+// are modified in place.
+func (e *JournalEntry) apply(index *Index, owned map[reference.Named]bool) error {
+	repositoryRef, err := reference.ParseNamed(e.Repository)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid repository in journal entry %d", e.Sequence)
+	}
+	repositoryRef = reference.TrimNamed(repositoryRef)
+
+	switch e.Operation {
+	case JournalUpsertImage:
+		if e.Image == nil {
+			return errors.Errorf("Missing image in journal entry %d", e.Sequence)
+		}
+		index.upsertImage(repositoryRef, e.Image, owned)
+	case JournalDeleteImage:
+		index.deleteTag(repositoryRef, e.Tag, owned)
+	case JournalReplaceRepository:
+		index.repositories[repositoryRef] = RepositoryFromImages(repositoryRef, e.Images...)
+		delete(owned, repositoryRef)
+	case JournalDeleteRepository:
+		delete(index.repositories, repositoryRef)
+		delete(owned, repositoryRef)
+	default:
+		return errors.Errorf("Unknown operation %q in journal entry %d", e.Operation, e.Sequence)
+	}
+	return nil
+}
+
+// fileJournal is a Journal in a file of newline delimited JSON entries.
+//
+// Entries are not synced to disk individually, so the journal survives a
+// crash of the process, but not necessarily a crash of the host.
+type fileJournal struct {
+	path  string
+	file  *os.File
+	mutex sync.Mutex
+}
+
+func newFileJournal(path string) *fileJournal {
+	return &fileJournal{
+		path: path,
+	}
+}
+
+func (j *fileJournal) Append(entry *JournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file == nil {
+		if j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	_, err = j.file.Write(append(line, '\n'))
+	return errors.WithStack(err)
+}
+
+func (j *fileJournal) Replay(apply func(*JournalEntry) error) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	entries, err := j.read()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := apply(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *fileJournal) Compact(sequence uint64) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.file != nil {
+		if err := j.file.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+		j.file = nil
+	}
+
+	entries, err := j.read()
+	if err != nil {
+		return err
+	}
+	var remaining bytes.Buffer
+	encoder := json.NewEncoder(&remaining)
+	for _, entry := range entries {
+		if entry.Sequence <= sequence {
+			continue
+		}
+		if err := encoder.Encode(entry); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if remaining.Len() == 0 {
+		if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+	return writeFileAtomic(j.path, func(w io.Writer) error {
+		_, err := remaining.WriteTo(w)
+		return errors.WithStack(err)
+	})
+}
+
+// read reads all entries of the journal. A torn entry at the end of the
+// journal, as left by a crash while appending, is ignored.
+func (j *fileJournal) read() ([]*JournalEntry, error) {
+	f, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	var entries []*JournalEntry
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Ignoring torn entry at the end of journal %s", j.path)
+			}
+			return entries, nil
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		var entry JournalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, errors.Wrapf(err, "Invalid entry in journal %s", j.path)
+		}
+		entries = append(entries, &entry)
+	}
+}
+
+// journalFlushInterval is how long entries of an objectJournal are buffered,
+// before they're written in a segment
+const journalFlushInterval = time.Second
+
+// journalObjects are the objects of an object store holding the segments of
+// an objectJournal
+type journalObjects interface {
+	putObject(name string, data []byte) error
+	getObject(name string) ([]byte, error)
+	listObjects(prefix string) ([]string, error)
+	deleteObject(name string) error
+}
+
+// objectJournal is a Journal in an object store. Objects can't be appended
+// to, so entries are buffered for up to journalFlushInterval, and written in
+// a segment object of newline delimited JSON entries, named by the prefix and
+// the sequence of its last entry. A crash loses the buffered entries.
+type objectJournal struct {
+	objects journalObjects
+	prefix  string
+
+	pending      []*JournalEntry
+	flushing     bool
+	pendingMutex sync.Mutex
+
+	// segmentMutex serializes writing and compacting segments, so a segment
+	// of compacted entries is never written after the compaction
+	segmentMutex sync.Mutex
+}
+
+func newObjectJournal(objects journalObjects, prefix string) *objectJournal {
+	return &objectJournal{
+		objects: objects,
+		prefix:  prefix,
+	}
+}
+
+func (j *objectJournal) Append(entry *JournalEntry) error {
+	j.pendingMutex.Lock()
+	defer j.pendingMutex.Unlock()
+	j.pending = append(j.pending, entry)
+	if !j.flushing {
+		j.flushing = true
+		time.AfterFunc(journalFlushInterval, j.flush)
+	}
+	return nil
+}
+
+// flush writes the pending entries in a segment. If writing fails, the
+// entries are kept pending, and written in a later segment.
+func (j *objectJournal) flush() {
+	j.segmentMutex.Lock()
+	defer j.segmentMutex.Unlock()
+
+	j.pendingMutex.Lock()
+	entries := j.pending
+	j.pending = nil
+	j.pendingMutex.Unlock()
+
+	err := j.writeSegment(entries)
+	j.pendingMutex.Lock()
+	defer j.pendingMutex.Unlock()
+	if err != nil {
+		journalFailures.Add(float64(len(entries)))
+		log.Printf("[index] Unable to write %d journal entries: %v", len(entries), err)
+		j.pending = append(entries, j.pending...)
+	}
+	if len(j.pending) > 0 {
+		time.AfterFunc(journalFlushInterval, j.flush)
+	} else {
+		j.flushing = false
+	}
+}
+
+// writeSegment writes entries in a segment, which must be locked
+func (j *objectJournal) writeSegment(entries []*JournalEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var segment bytes.Buffer
+	encoder := json.NewEncoder(&segment)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return j.objects.putObject(j.segmentName(entries[len(entries)-1].Sequence), segment.Bytes())
+}
+
+func (j *objectJournal) segmentName(sequence uint64) string {
+	return fmt.Sprintf("%s%020d", j.prefix, sequence)
+}
+
+func (j *objectJournal) Replay(apply func(*JournalEntry) error) error {
+	j.segmentMutex.Lock()
+	defer j.segmentMutex.Unlock()
+
+	names, err := j.objects.listObjects(j.prefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		entries, err := j.readSegment(name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := apply(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (j *objectJournal) Compact(sequence uint64) error {
+	j.segmentMutex.Lock()
+	defer j.segmentMutex.Unlock()
+
+	j.pendingMutex.Lock()
+	pending := make([]*JournalEntry, 0, len(j.pending))
+	for _, entry := range j.pending {
+		if entry.Sequence > sequence {
+			pending = append(pending, entry)
+		}
+	}
+	j.pending = pending
+	j.pendingMutex.Unlock()
+
+	names, err := j.objects.listObjects(j.prefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		last, err := strconv.ParseUint(strings.TrimPrefix(name, j.prefix), 10, 64)
+		if err != nil {
+			return errors.Errorf("Invalid journal segment %s", name)
+		}
+		if last <= sequence {
+			if err := j.objects.deleteObject(name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Rewrite a segment, which is partially contained in the snapshot
+		entries, err := j.readSegment(name)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 || entries[0].Sequence > sequence {
+			continue
+		}
+		remaining := make([]*JournalEntry, 0, len(entries))
+		for _, entry := range entries {
+			if entry.Sequence > sequence {
+				remaining = append(remaining, entry)
+			}
+		}
+		if err := j.writeSegment(remaining); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegment reads the entries of a segment
+func (j *objectJournal) readSegment(name string) ([]*JournalEntry, error) {
+	data, err := j.objects.getObject(name)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*JournalEntry
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var entry JournalEntry
+		if err := decoder.Decode(&entry); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "Invalid entry in journal segment %s", name)
+		}
+		entries = append(entries, &entry)
+	}
+}
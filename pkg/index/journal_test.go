@@ -0,0 +1,126 @@
+package index
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// memoryObjects are journalObjects in memory
+type memoryObjects struct {
+	objects map[string][]byte
+	mutex   sync.Mutex
+}
+
+func newMemoryObjects() *memoryObjects {
+	return &memoryObjects{objects: make(map[string][]byte)}
+}
+
+func (m *memoryObjects) putObject(name string, data []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.objects[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *memoryObjects) getObject(name string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, ok := m.objects[name]
+	if !ok {
+		return nil, errors.Errorf("No such object %s", name)
+	}
+	return data, nil
+}
+
+func (m *memoryObjects) listObjects(prefix string) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var names []string
+	for name := range m.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *memoryObjects) deleteObject(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.objects, name)
+	return nil
+}
+
+func replayedSequences(t *testing.T, journal Journal) []uint64 {
+	var sequences []uint64
+	err := journal.Replay(func(entry *JournalEntry) error {
+		sequences = append(sequences, entry.Sequence)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+	return sequences
+}
+
+func appendEntries(t *testing.T, journal Journal, from uint64, to uint64) {
+	for sequence := from; sequence <= to; sequence++ {
+		err := journal.Append(&JournalEntry{
+			Sequence:   sequence,
+			Operation:  JournalDeleteImage,
+			Repository: "registry.example.com/team/app",
+			Tag:        "v1",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestObjectJournal(t *testing.T) {
+	objects := newMemoryObjects()
+	journal := newObjectJournal(objects, "state.json.journal/")
+
+	appendEntries(t, journal, 1, 3)
+	journal.flush()
+	appendEntries(t, journal, 4, 5)
+	journal.flush()
+	if got := len(objects.objects); got != 2 {
+		t.Fatalf("journal has %d segments, want 2", got)
+	}
+
+	// A new journal on the same objects, as after a crash, replays every
+	// flushed entry in order
+	if got := replayedSequences(t, newObjectJournal(objects, "state.json.journal/")); len(got) != 5 || got[0] != 1 || got[4] != 5 {
+		t.Fatalf("Replay() = %v, want 1 to 5", got)
+	}
+
+	// Compacting deletes contained segments, and rewrites a partially
+	// contained segment
+	appendEntries(t, journal, 6, 6)
+	if err := journal.Compact(4); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	journal.flush()
+	if got := replayedSequences(t, journal); len(got) != 2 || got[0] != 5 || got[1] != 6 {
+		t.Fatalf("Replay() after Compact(4) = %v, want [5 6]", got)
+	}
+
+	// Compacting drops pending entries in the snapshot
+	appendEntries(t, journal, 7, 8)
+	if err := journal.Compact(8); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	journal.flush()
+	if got := replayedSequences(t, journal); len(got) != 0 {
+		t.Fatalf("Replay() after Compact(8) = %v, want none", got)
+	}
+	if got := len(objects.objects); got != 0 {
+		t.Fatalf("journal has %d segments after compaction, want 0", got)
+	}
+}
@@ -0,0 +1,103 @@
+package index
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	fetchErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "fetch_errors_total",
+			Help:      "Total number of repositories and images, which failed to fetch",
+		},
+		[]string{"registry", "kind"},
+	)
+
+	configCacheRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "config_cache_requests_total",
+			Help:      "Total number of image config cache lookups",
+		},
+		[]string{"result"},
+	)
+
+	reconciliationChanges = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "reconciliation_changes_total",
+			Help:      "Total number of repositories and tags added, changed, removed or skipped by reconciliations",
+		},
+		[]string{"registry", "kind", "change"},
+	)
+
+	reconciliationFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "reconciliation_failures_total",
+			Help:      "Total number of reconciliations, which failed to crawl a registry",
+		},
+		[]string{"registry"},
+	)
+
+	reconciliationTimestamp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "registryindexer",
+			Name:      "reconciliation_timestamp_seconds",
+			Help:      "Time of the last successful reconciliation of a registry",
+		},
+		[]string{"registry"},
+	)
+
+	driftedTags = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "drifted_tags_total",
+			Help:      "Total number of tags, which scheduled reconciliations found missing, stale or orphaned in the index",
+		},
+		[]string{"registry", "kind"},
+	)
+
+	snapshotTimestamp = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "registryindexer",
+			Name:      "snapshot_timestamp_seconds",
+			Help:      "Time of the last successful snapshot of the state",
+		},
+	)
+
+	snapshotFailures = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "snapshot_failures_total",
+			Help:      "Total number of snapshots of the state, which failed to save",
+		},
+	)
+
+	journalEntries = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "journal_entries_total",
+			Help:      "Total number of index mutations appended to the journal",
+		},
+	)
+
+	journalFailures = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "journal_failures_total",
+			Help:      "Total number of index mutations, which failed to append to the journal",
+		},
+	)
+
+	backendCacheRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "backend_cache_requests_total",
+			Help:      "Total number of repository lookups in the memory cache of an on-disk index",
+		},
+		[]string{"result"},
+	)
+)
@@ -0,0 +1,82 @@
+package index
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	// DefaultMaxWorkers is the default global cap on concurrent fetches
+	DefaultMaxWorkers = 64
+
+	// DefaultWorkersPerRegistry is the default cap on concurrent fetches per registry
+	DefaultWorkersPerRegistry = 16
+)
+
+// WorkerPool bounds the number of concurrent fetches during crawls, both
+// per registry and globally across all registries.
+//
+// A task must hold a single worker slot while it runs, and must never wait
+// for another worker slot, as that could deadlock the pool.
+type WorkerPool struct {
+	global             chan struct{}
+	workersPerRegistry int
+	registries         map[string]chan struct{}
+	mutex              sync.Mutex
+}
+
+// NewWorkerPool creates a new WorkerPool. Non-positive limits are replaced by defaults.
+func NewWorkerPool(maxWorkers int, workersPerRegistry int) *WorkerPool {
+	if maxWorkers <= 0 {
+		maxWorkers = DefaultMaxWorkers
+	}
+	if workersPerRegistry <= 0 {
+		workersPerRegistry = DefaultWorkersPerRegistry
+	}
+	return &WorkerPool{
+		global:             make(chan struct{}, maxWorkers),
+		workersPerRegistry: workersPerRegistry,
+		registries:         make(map[string]chan struct{}),
+	}
+}
+
+// Go waits for a free worker slot for a registry, and runs task in a new
+// goroutine tracked by wg. Go returns the context error without running task,
+// if the context is cancelled while waiting.
+func (p *WorkerPool) Go(ctx context.Context, registry string, wg *sync.WaitGroup, task func()) error {
+	registrySlots := p.registrySlots(registry)
+
+	select {
+	case registrySlots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case p.global <- struct{}{}:
+	case <-ctx.Done():
+		<-registrySlots
+		return ctx.Err()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			<-p.global
+			<-registrySlots
+		}()
+		task()
+	}()
+	return nil
+}
+
+func (p *WorkerPool) registrySlots(registry string) chan struct{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	slots, ok := p.registries[registry]
+	if !ok {
+		slots = make(chan struct{}, p.workersPerRegistry)
+		p.registries[registry] = slots
+	}
+	return slots
+}
@@ -0,0 +1,298 @@
+package index
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// MaxDriftReport is the maximum number of drifted tags reported per registry
+const MaxDriftReport = 1000
+
+// Reconciliation summarises the last reconciliation of each registry
+type Reconciliation struct {
+	Registries []*RegistryReconciliation `json:"registries"`
+}
+
+// RegistryReconciliation summarises the changes applied to the index for a
+// single registry. A registry which failed to crawl is left unchanged in the
+// index, and carries the error.
+//
+// Tags which changed in the index while the registry was crawled, e.g. by
+// notifications, are newer than the crawl. They are left untouched and
+// counted as skipped.
+//
+// Scheduled reconciliations expect the index to be kept up to date by
+// notifications, so every tag they add, change or remove is drift, which the
+// event stream missed or got wrong. Drift is reported for up to
+// MaxDriftReport tags.
+type RegistryReconciliation struct {
+	Registry            string    `json:"registry"`
+	Scheduled           bool      `json:"scheduled"`
+	Started             time.Time `json:"started"`
+	Finished            time.Time `json:"finished"`
+	Error               string    `json:"error,omitempty"`
+	FetchErrors         int       `json:"fetch_errors"`
+	RepositoriesAdded   int       `json:"repositories_added"`
+	RepositoriesChanged int       `json:"repositories_changed"`
+	RepositoriesRemoved int       `json:"repositories_removed"`
+	TagsAdded           int       `json:"tags_added"`
+	TagsChanged         int       `json:"tags_changed"`
+	TagsRemoved         int       `json:"tags_removed"`
+	TagsSkipped         int       `json:"tags_skipped"`
+	DriftedTags         int       `json:"drifted_tags"`
+	Drift               []*Drift  `json:"drift,omitempty"`
+}
+
+// DriftKind describes how the index disagreed with a registry
+type DriftKind string
+
+const (
+	// DriftMissing is a tag in the registry, which was missing from the index
+	DriftMissing DriftKind = "missing"
+
+	// DriftStale is a tag, which was indexed with another image than in the registry
+	DriftStale DriftKind = "stale"
+
+	// DriftOrphaned is a tag in the index, which was deleted from the registry
+	DriftOrphaned DriftKind = "orphaned"
+)
+
+// Drift describes a tag, where the index disagreed with the registry
+type Drift struct {
+	Image          string        `json:"image"`
+	Kind           DriftKind     `json:"kind"`
+	IndexedDigest  digest.Digest `json:"indexed_digest,omitempty"`
+	RegistryDigest digest.Digest `json:"registry_digest,omitempty"`
+}
+
+// addDrift records a drifted tag, if the reconciliation is scheduled
+func (r *RegistryReconciliation) addDrift(repositoryRef reference.Named, tag string, kind DriftKind, indexed *Image, image *Image) {
+	if !r.Scheduled {
+		return
+	}
+	r.DriftedTags++
+	driftedTags.WithLabelValues(r.Registry, string(kind)).Inc()
+	if len(r.Drift) >= MaxDriftReport {
+		return
+	}
+
+	drift := &Drift{
+		Image: repositoryRef.String() + ":" + tag,
+		Kind:  kind,
+	}
+	if indexed != nil {
+		drift.IndexedDigest = indexed.Digest
+	}
+	if image != nil {
+		drift.RegistryDigest = image.Digest
+	}
+	r.Drift = append(r.Drift, drift)
+}
+
+func (r *RegistryReconciliation) String() string {
+	if r.Error != "" {
+		return fmt.Sprintf("%s: failed: %s", r.Registry, r.Error)
+	}
+	return fmt.Sprintf(
+		"%s: repositories %d added, %d changed, %d removed; tags %d added, %d changed, %d removed, %d skipped; %d fetch errors; %d drifted tags",
+		r.Registry,
+		r.RepositoriesAdded, r.RepositoriesChanged, r.RepositoriesRemoved,
+		r.TagsAdded, r.TagsChanged, r.TagsRemoved, r.TagsSkipped,
+		r.FetchErrors, r.DriftedTags,
+	)
+}
+
+// observe records the changes in metrics
+func (r *RegistryReconciliation) observe() {
+	if r.Error != "" {
+		reconciliationFailures.WithLabelValues(r.Registry).Inc()
+		return
+	}
+	reconciliationChanges.WithLabelValues(r.Registry, "repository", "added").Add(float64(r.RepositoriesAdded))
+	reconciliationChanges.WithLabelValues(r.Registry, "repository", "changed").Add(float64(r.RepositoriesChanged))
+	reconciliationChanges.WithLabelValues(r.Registry, "repository", "removed").Add(float64(r.RepositoriesRemoved))
+	reconciliationChanges.WithLabelValues(r.Registry, "tag", "added").Add(float64(r.TagsAdded))
+	reconciliationChanges.WithLabelValues(r.Registry, "tag", "changed").Add(float64(r.TagsChanged))
+	reconciliationChanges.WithLabelValues(r.Registry, "tag", "removed").Add(float64(r.TagsRemoved))
+	reconciliationChanges.WithLabelValues(r.Registry, "tag", "skipped").Add(float64(r.TagsSkipped))
+	reconciliationTimestamp.WithLabelValues(r.Registry).SetToCurrentTime()
+}
+
+// domainRepositories returns the names of the indexed repositories in a
+// registry domain
+func (i *Index) domainRepositories(domain string) ([]reference.Named, error) {
+	i.rwmutex.RLock()
+	defer i.rwmutex.RUnlock()
+	var result []reference.Named
+	for repositoryRef := range i.repositories {
+		if reference.Domain(repositoryRef) == domain {
+			result = append(result, repositoryRef)
+		}
+	}
+	return result, nil
+}
+
+// repositoryImages returns the indexed images of a repository by tag, or nil
+// if it isn't indexed
+func (i *Index) repositoryImages(repositoryRef reference.Named) (map[string]*Image, error) {
+	i.rwmutex.RLock()
+	defer i.rwmutex.RUnlock()
+	return i.indexedImages(repositoryRef), nil
+}
+
+// indexedImages returns the indexed images of a repository by tag, or nil if
+// it isn't indexed. The index must be locked.
+func (i *Index) indexedImages(repositoryRef reference.Named) map[string]*Image {
+	repository, ok := i.repositories[reference.TrimNamed(repositoryRef)]
+	if !ok {
+		return nil
+	}
+	return imagesByTag(repository)
+}
+
+// imagesByTag returns a copy of the images of a repository by tag, or nil
+// for a nil repository
+func imagesByTag(repository *Repository) map[string]*Image {
+	if repository == nil {
+		return nil
+	}
+	images := make(map[string]*Image, len(repository.imageByTag))
+	for tag, image := range repository.imageByTag {
+		images[tag] = image
+	}
+	return images
+}
+
+// reconcileRepository applies the difference between a crawled repository
+// and the images indexed when its crawl started. Every change is journaled.
+func (i *Index) reconcileRepository(repositoryRef reference.Named, baseline map[string]*Image, crawled *Repository, result *RegistryReconciliation) error {
+	i.rwmutex.Lock()
+	defer i.rwmutex.Unlock()
+
+	changes := reconcileChanges(repositoryRef, baseline, i.indexedImages(repositoryRef), crawled, result)
+	owned := make(map[reference.Named]bool)
+	for _, change := range changes {
+		if err := change.apply(i, owned); err != nil {
+			return err
+		}
+		i.record(change)
+	}
+	return nil
+}
+
+// reconcileChanges returns the changes, which reconcile the currently indexed
+// images of a repository with the crawled repository, and counts them in
+// result. A nil map of images is a repository which isn't indexed, and a nil
+// crawled repository is gone from the registry. Tags which have changed in
+// the index since the baseline was taken at the start of the crawl of the
+// repository are left untouched.
+func reconcileChanges(repositoryRef reference.Named, baseline map[string]*Image, current map[string]*Image, crawled *Repository, result *RegistryReconciliation) []*JournalEntry {
+	if current == nil {
+		if crawled == nil {
+			return nil
+		}
+		if baseline != nil {
+			// Removed from the index during the crawl
+			result.TagsSkipped += len(crawled.Images)
+			return nil
+		}
+		for _, image := range crawled.Images {
+			result.addDrift(repositoryRef, image.Tag, DriftMissing, nil, image)
+		}
+		result.RepositoriesAdded++
+		result.TagsAdded += len(crawled.Images)
+		return []*JournalEntry{{
+			Operation:  JournalReplaceRepository,
+			Repository: repositoryRef.String(),
+			Images:     crawled.Images,
+		}}
+	}
+
+	tags := make(map[string]struct{})
+	for tag := range baseline {
+		tags[tag] = struct{}{}
+	}
+	for tag := range current {
+		tags[tag] = struct{}{}
+	}
+	if crawled != nil {
+		for tag := range crawled.imageByTag {
+			tags[tag] = struct{}{}
+		}
+	}
+
+	var changes []*JournalEntry
+	remaining := len(current)
+	for tag := range tags {
+		indexed := current[tag]
+		if !sameIndexed(indexed, baseline[tag]) {
+			result.TagsSkipped++
+			continue
+		}
+		var image *Image
+		if crawled != nil {
+			image = crawled.imageByTag[tag]
+		}
+
+		switch {
+		case indexed == nil && image == nil:
+			continue
+		case indexed == nil:
+			result.TagsAdded++
+			result.addDrift(repositoryRef, tag, DriftMissing, nil, image)
+			remaining++
+		case image == nil:
+			result.TagsRemoved++
+			result.addDrift(repositoryRef, tag, DriftOrphaned, indexed, nil)
+			remaining--
+		case !sameImage(indexed, image):
+			result.TagsChanged++
+			result.addDrift(repositoryRef, tag, DriftStale, indexed, image)
+		default:
+			continue
+		}
+
+		if image == nil {
+			changes = append(changes, &JournalEntry{
+				Operation:  JournalDeleteImage,
+				Repository: repositoryRef.String(),
+				Tag:        tag,
+			})
+		} else {
+			changes = append(changes, &JournalEntry{
+				Operation:  JournalUpsertImage,
+				Repository: repositoryRef.String(),
+				Image:      image,
+			})
+		}
+	}
+
+	switch {
+	case crawled == nil && remaining == 0:
+		changes = append(changes, &JournalEntry{
+			Operation:  JournalDeleteRepository,
+			Repository: repositoryRef.String(),
+		})
+		result.RepositoriesRemoved++
+	case len(changes) > 0:
+		result.RepositoriesChanged++
+	}
+	return changes
+}
+
+// sameIndexed reports whether a tag is indexed with the same image in two
+// views of the index, where nil is an unindexed tag
+func sameIndexed(a *Image, b *Image) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a == b || sameImage(a, b)
+}
+
+// sameImage reports whether two images of the same tag are identical
+func sameImage(a *Image, b *Image) bool {
+	return a.Digest == b.Digest && a.ConfigDigest == b.ConfigDigest && a.Created.Equal(b.Created)
+}
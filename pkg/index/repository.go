@@ -1,44 +1,81 @@
 package index
 
 import (
-	"log"
+	"context"
 	"sort"
 	"sync"
 
 	"github.com/parmus/registryindexer/pkg/registry"
 	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
 )
 
+// Repository contains the images of a single repository. A Repository must
+// not be modified once it is in an Index; modify a clone instead.
 type Repository struct {
-	Name       reference.Named
-	Images     []*Image
-	imageByTag map[string]*Image
+	Name           reference.Named
+	Images         []*Image
+	imageByTag     map[string]*Image
+	imagesByDigest map[digest.Digest][]*Image
 }
 
 // RepositoryFromImages creates a new Repository from a single Image
 func RepositoryFromImages(repositoryRef reference.Named, images ...*Image) *Repository {
 	repository := Repository{
-		Name:       reference.TrimNamed(repositoryRef),
-		Images:     make([]*Image, 0, len(images)),
-		imageByTag: make(map[string]*Image),
+		Name:           reference.TrimNamed(repositoryRef),
+		Images:         make([]*Image, 0, len(images)),
+		imageByTag:     make(map[string]*Image),
+		imagesByDigest: make(map[digest.Digest][]*Image),
 	}
 	repository.Images = images
 	for _, image := range images {
 		repository.imageByTag[image.Tag] = image
+		repository.indexDigests(image)
 	}
 	repository.sort()
 
 	return &repository
 }
 
+// clone returns a copy of the repository, which can be modified without
+// affecting the original
+func (r *Repository) clone() *Repository {
+	clone := &Repository{
+		Name:           r.Name,
+		Images:         make([]*Image, len(r.Images)),
+		imageByTag:     make(map[string]*Image, len(r.imageByTag)),
+		imagesByDigest: make(map[digest.Digest][]*Image, len(r.imagesByDigest)),
+	}
+	copy(clone.Images, r.Images)
+	for tag, image := range r.imageByTag {
+		clone.imageByTag[tag] = image
+	}
+	for dgst, images := range r.imagesByDigest {
+		clone.imagesByDigest[dgst] = append([]*Image(nil), images...)
+	}
+	return clone
+}
+
 // GetImage gets an image by it's tag name
 func (r *Repository) GetImage(imageRef reference.NamedTagged) *Image {
 	return r.imageByTag[imageRef.Tag()]
 }
 
+// GetImagesByDigest gets all images, where either the image or one of its
+// platforms has a specific manifest digest
+func (r *Repository) GetImagesByDigest(dgst digest.Digest) []*Image {
+	images := make([]*Image, len(r.imagesByDigest[dgst]))
+	copy(images, r.imagesByDigest[dgst])
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Created.After(images[j].Created)
+	})
+	return images
+}
+
 // UpdateImage adds or updates an image in the repository
 func (r *Repository) UpdateImage(image *Image) {
-	if _, ok := r.imageByTag[image.Tag]; ok {
+	if existing, ok := r.imageByTag[image.Tag]; ok {
+		r.unindexDigests(existing)
 		images := make([]*Image, 0, len(r.Images)+1)
 		for _, i := range r.Images {
 			if i.Tag == image.Tag {
@@ -53,12 +90,18 @@ func (r *Repository) UpdateImage(image *Image) {
 	}
 	r.sort()
 	r.imageByTag[image.Tag] = image
+	r.indexDigests(image)
 }
 
 // DeleteImage deletes an image from the repository
 func (r *Repository) DeleteImage(imageRef reference.NamedTagged) {
-	imageTag := imageRef.Tag()
-	if _, ok := r.imageByTag[imageTag]; ok {
+	r.deleteTag(imageRef.Tag())
+}
+
+// deleteTag deletes an image from the repository by tag
+func (r *Repository) deleteTag(imageTag string) {
+	if existing, ok := r.imageByTag[imageTag]; ok {
+		r.unindexDigests(existing)
 		images := make([]*Image, 0, len(r.Images)-1)
 		for _, image := range r.Images {
 			if image.Tag != imageTag {
@@ -70,72 +113,84 @@ func (r *Repository) DeleteImage(imageRef reference.NamedTagged) {
 	delete(r.imageByTag, imageTag)
 }
 
-// FetchRepository fetch a whole repository from a registry
-func FetchRepository(registry *registry.Registry, repositoryRef reference.Named) (*Repository, error) {
-	ch := make(chan *Image)
-	tags, err := registry.GetTags(repositoryRef)
+// FetchRepository fetch a whole repository from a registry, fetching the
+// tag list and images in the worker pool. Images which fail to fetch are
+// left out of the repository and reported in the returned FetchErrors. If
+// the tags of the repository can't be listed, the returned Repository is
+// nil. An error is only returned if the context is cancelled.
+func FetchRepository(ctx context.Context, pool *WorkerPool, cache *ConfigCache, registry *registry.Registry, repositoryRef reference.Named) (*Repository, FetchErrors, error) {
+	var wg sync.WaitGroup
+	var tags []reference.NamedTagged
+	var tagsErr error
+	err := pool.Go(ctx, registry.Hostname(), &wg, func() {
+		tags, tagsErr = registry.GetTags(ctx, repositoryRef)
+	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	var wg sync.WaitGroup
-	for _, tag := range tags {
-		wg.Add(1)
-		go func(tag reference.NamedTagged) {
-			defer wg.Done()
-			image, err := FetchImage(registry, tag)
-			if err != nil {
-				log.Fatalf("Failed to fetch image: %+v", err)
-			}
-			ch <- image
-		}(tag)
+	wg.Wait()
+	if tagsErr != nil {
+		return nil, FetchErrors{{Repository: reference.TrimNamed(repositoryRef), Err: tagsErr}}, nil
 	}
 
-	go func() {
-		wg.Wait()
-		close(ch)
-	}()
-
-	images := make([]*Image, 0, len(tags))
-	for image := range ch {
-		images = append(images, image)
+	images, errs, err := fetchImages(ctx, pool, cache, registry, tags)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return RepositoryFromImages(repositoryRef, images...), nil
+	return RepositoryFromImages(repositoryRef, images[reference.TrimNamed(repositoryRef).String()]...), errs, nil
 }
 
-// FetchRepositories fetch all repositories from a registry
-func FetchRepositories(registry *registry.Registry) (map[reference.Named]*Repository, error) {
-	ch := make(chan *Repository)
-
+// fetchImages fetches images in the worker pool, and returns them by
+// repository name. An error is only returned if the context is cancelled.
+func fetchImages(ctx context.Context, pool *WorkerPool, cache *ConfigCache, registry *registry.Registry, tags []reference.NamedTagged) (map[string][]*Image, FetchErrors, error) {
+	var mutex sync.Mutex
 	var wg sync.WaitGroup
-	repos, err := registry.GetCatalog()
-	if err != nil {
-		return nil, err
-	}
+	var errs FetchErrors
+	images := make(map[string][]*Image)
+	for _, tag := range tags {
+		tag := tag
+		err := pool.Go(ctx, registry.Hostname(), &wg, func() {
+			image, err := FetchImage(ctx, registry, cache, tag)
 
-	for _, repositoryName := range repos {
-		wg.Add(1)
-		go func(repositoryName reference.Named) {
-			defer wg.Done()
-			repository, err := FetchRepository(registry, repositoryName)
+			mutex.Lock()
+			defer mutex.Unlock()
+			repositoryName := reference.TrimNamed(tag)
 			if err != nil {
-				log.Fatalf("Failed to fetch repository: %+v", err)
+				errs = append(errs, &FetchError{Repository: repositoryName, Image: tag, Err: err})
+				return
 			}
-			ch <- repository
-		}(repositoryName)
+			images[repositoryName.String()] = append(images[repositoryName.String()], image)
+		})
+		if err != nil {
+			wg.Wait()
+			return nil, nil, err
+		}
 	}
+	wg.Wait()
+	return images, errs, nil
+}
 
-	go func() {
-		wg.Wait()
-		close(ch)
-	}()
+func (r *Repository) indexDigests(image *Image) {
+	for _, dgst := range image.Digests() {
+		r.imagesByDigest[dgst] = append(r.imagesByDigest[dgst], image)
+	}
+}
 
-	repositories := make(map[reference.Named]*Repository)
-	for repository := range ch {
-		repositories[repository.Name] = repository
+func (r *Repository) unindexDigests(image *Image) {
+	for _, dgst := range image.Digests() {
+		images := make([]*Image, 0, len(r.imagesByDigest[dgst]))
+		for _, i := range r.imagesByDigest[dgst] {
+			if i != image {
+				images = append(images, i)
+			}
+		}
+		if len(images) > 0 {
+			r.imagesByDigest[dgst] = images
+		} else {
+			delete(r.imagesByDigest, dgst)
+		}
 	}
-	return repositories, nil
 }
 
 func (r *Repository) sort() {
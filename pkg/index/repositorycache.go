@@ -0,0 +1,95 @@
+package index
+
+import (
+	"container/list"
+	"sync"
+)
+
+// repositoryCache is a LRU cache of the repositories read from a persistent
+// backend.
+//
+// Invalidations bump the generation of the cache, and a repository is only
+// added if the cache is still at the generation from before the repository
+// was read. A repository read before an invalidation is thus never cached
+// after it.
+type repositoryCache struct {
+	size       int
+	entries    map[string]*list.Element
+	order      *list.List
+	generation uint64
+	mutex      sync.Mutex
+}
+
+type repositoryCacheEntry struct {
+	name       string
+	repository *Repository
+}
+
+// newRepositoryCache creates a cache of up to size repositories. A size of
+// zero disables the cache.
+func newRepositoryCache(size int) *repositoryCache {
+	return &repositoryCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns a cached repository, or nil
+func (c *repositoryCache) get(name string) *Repository {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[name]
+	if !ok {
+		backendCacheRequests.WithLabelValues("miss").Inc()
+		return nil
+	}
+	backendCacheRequests.WithLabelValues("hit").Inc()
+	c.order.MoveToFront(element)
+	return element.Value.(*repositoryCacheEntry).repository
+}
+
+// currentGeneration returns the generation to pass to add for a repository,
+// which is about to be read
+func (c *repositoryCache) currentGeneration() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.generation
+}
+
+// add caches a repository read at a generation, evicting the least recently
+// used repository if the cache is full
+func (c *repositoryCache) add(name string, repository *Repository, generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.size <= 0 || generation != c.generation {
+		return
+	}
+	if element, ok := c.entries[name]; ok {
+		element.Value.(*repositoryCacheEntry).repository = repository
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[name] = c.order.PushFront(&repositoryCacheEntry{name: name, repository: repository})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*repositoryCacheEntry).name)
+	}
+}
+
+// invalidate removes repositories from the cache
+func (c *repositoryCache) invalidate(names ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+	for _, name := range names {
+		if element, ok := c.entries[name]; ok {
+			c.order.Remove(element)
+			delete(c.entries, name)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package index
+
+import (
+	"sync"
+
+	"github.com/docker/distribution/reference"
+)
+
+// retrySet contains the repositories and images, which failed to index
+// and should be retried
+type retrySet struct {
+	repositories map[string]reference.Named
+	images       map[string]reference.NamedTagged
+	mutex        sync.Mutex
+}
+
+func newRetrySet() *retrySet {
+	return &retrySet{
+		repositories: make(map[string]reference.Named),
+		images:       make(map[string]reference.NamedTagged),
+	}
+}
+
+// AddRepository marks a repository for retry
+func (r *retrySet) AddRepository(repositoryRef reference.Named) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.repositories[repositoryRef.String()] = repositoryRef
+}
+
+// AddImage marks an image for retry
+func (r *retrySet) AddImage(imageRef reference.NamedTagged) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.images[imageRef.String()] = imageRef
+}
+
+// AddFetchErrors marks all failed repositories and images for retry
+func (r *retrySet) AddFetchErrors(errs FetchErrors) {
+	for _, err := range errs {
+		if err.Image != nil {
+			r.AddImage(err.Image)
+		} else {
+			r.AddRepository(err.Repository)
+		}
+	}
+}
+
+// Len returns the number of repositories and images marked for retry
+func (r *retrySet) Len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.repositories) + len(r.images)
+}
+
+// Take empties the set and returns the repositories and images, which
+// were marked for retry
+func (r *retrySet) Take() ([]reference.Named, []reference.NamedTagged) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	repositories := make([]reference.Named, 0, len(r.repositories))
+	for _, repositoryRef := range r.repositories {
+		repositories = append(repositories, repositoryRef)
+	}
+	images := make([]reference.NamedTagged, 0, len(r.images))
+	for _, imageRef := range r.images {
+		images = append(images, imageRef)
+	}
+	r.repositories = make(map[string]reference.Named)
+	r.images = make(map[string]reference.NamedTagged)
+	return repositories, images
+}
@@ -0,0 +1,199 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/errors"
+)
+
+// defaultS3Endpoint is the endpoint of AWS S3
+const defaultS3Endpoint = "s3.amazonaws.com"
+
+// s3Storage stores the state in an object in AWS S3, or in any S3-compatible
+// object store.
+//
+// The state is addressed as s3://bucket/key. The query parameters endpoint,
+// region and insecure (plain HTTP) configure the object store, so a local
+// MinIO is addressed as s3://bucket/key?endpoint=localhost:9000&insecure=true.
+// Credentials are discovered from the AWS and MinIO environment variables,
+// the AWS credentials file, and finally the EC2/ECS instance role. A journal
+// is kept in segment objects next to the state object.
+type s3Storage struct {
+	ctx         context.Context
+	client      *minio.Client
+	bucket      string
+	object      string
+	compression Compression
+	journal     *objectJournal
+	readOnly    bool
+}
+
+func newS3Storage(uri *url.URL, compression Compression, ctx context.Context) (*s3Storage, error) {
+	query := uri.Query()
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = defaultS3Endpoint
+	}
+	insecure := false
+	if value := query.Get("insecure"); value != "" {
+		var err error
+		if insecure, err = strconv.ParseBool(value); err != nil {
+			return nil, errors.Wrapf(err, "Invalid insecure parameter %q", value)
+		}
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		}),
+		Secure: !insecure,
+		Region: query.Get("region"),
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	exists, err := client.BucketExists(ctx, uri.Host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error checking bucket %s", uri.Host)
+	}
+	if !exists {
+		return nil, errors.Errorf("Bucket %s does not exist", uri.Host)
+	}
+
+	object := strings.TrimLeft(uri.Path, "/")
+	if object == "" {
+		return nil, errors.Errorf("Missing object key in %s", uri.Redacted())
+	}
+
+	s3 := &s3Storage{
+		ctx:         ctx,
+		client:      client,
+		bucket:      uri.Host,
+		object:      object,
+		compression: compression,
+	}
+	s3.journal = newObjectJournal(s3, object+journalSuffix+"/")
+	return s3, nil
+}
+
+func (c *s3Storage) LoadIndex() (*Index, error) {
+	index := NewIndex()
+	if err := c.load(c.object, index); err != nil {
+		return nil, err
+	}
+	return loadJournal(c, index, c.journal, c.readOnly)
+}
+
+func (c *s3Storage) SaveIndex(index *Index) error {
+	snapshot := index.Snapshot()
+	if err := c.save(c.object, snapshot, snapshot.Registries()); err != nil {
+		return err
+	}
+	return errors.Wrap(c.journal.Compact(snapshot.Mutations()), "Error compacting journal")
+}
+
+func (c *s3Storage) LoadConfigCache() (*ConfigCache, error) {
+	cache := NewConfigCache()
+	if err := c.load(c.object+configCacheSuffix, cache); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+func (c *s3Storage) SaveConfigCache(cache *ConfigCache) error {
+	return c.save(c.object+configCacheSuffix, cache, nil)
+}
+
+// load decodes an object into v. A missing object leaves v untouched.
+func (c *s3Storage) load(object string, v interface{}) error {
+	reader, err := c.client.GetObject(c.ctx, c.bucket, object, minio.GetObjectOptions{})
+	if err != nil {
+		return c.wrapError(err)
+	}
+	defer reader.Close()
+
+	if err := decodeState(reader, v); err != nil {
+		if minio.ToErrorResponse(errors.Cause(err)).Code == "NoSuchKey" {
+			return nil
+		}
+		return c.wrapError(err)
+	}
+	return nil
+}
+
+// save encodes v into an object, with a header covering registries
+func (c *s3Storage) save(object string, v interface{}, registries []string) error {
+	var buffer bytes.Buffer
+	if err := encodeState(&buffer, v, registries, c.compression); err != nil {
+		return err
+	}
+
+	_, err := c.client.PutObject(c.ctx, c.bucket, object, &buffer, int64(buffer.Len()), minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	if err != nil {
+		return c.wrapError(err)
+	}
+	return nil
+}
+
+func (c *s3Storage) putObject(name string, data []byte) error {
+	_, err := c.client.PutObject(c.ctx, c.bucket, name, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: "application/x-ndjson",
+	})
+	if err != nil {
+		return c.wrapError(err)
+	}
+	return nil
+}
+
+func (c *s3Storage) getObject(name string) ([]byte, error) {
+	reader, err := c.client.GetObject(c.ctx, c.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, c.wrapError(err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, c.wrapError(err)
+	}
+	return data, nil
+}
+
+func (c *s3Storage) listObjects(prefix string) ([]string, error) {
+	var names []string
+	for object := range c.client.ListObjects(c.ctx, c.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, c.wrapError(object.Err)
+		}
+		names = append(names, object.Key)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (c *s3Storage) deleteObject(name string) error {
+	if err := c.client.RemoveObject(c.ctx, c.bucket, name, minio.RemoveObjectOptions{}); err != nil {
+		return c.wrapError(err)
+	}
+	return nil
+}
+
+func (c *s3Storage) wrapError(err error) error {
+	if minio.ToErrorResponse(errors.Cause(err)).Code == "NoSuchBucket" {
+		return errors.Wrapf(err, "Bucket %s does not exist", c.bucket)
+	}
+	return errors.WithStack(err)
+}
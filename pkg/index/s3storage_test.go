@@ -0,0 +1,164 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// newMinioBucket creates a bucket in the local MinIO at MINIO_ENDPOINT, e.g.
+// localhost:9000, or skips the test without one. Credentials are taken from
+// the AWS or MinIO environment variables, like the S3 state storage does.
+func newMinioBucket(t *testing.T) (endpoint string, bucket string) {
+	endpoint = os.Getenv("MINIO_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("MINIO_ENDPOINT isn't set")
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	bucket = fmt.Sprintf("registryindexer-test-%d", time.Now().UnixNano())
+	if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for object := range client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Recursive: true}) {
+			client.RemoveObject(ctx, bucket, object.Key, minio.RemoveObjectOptions{})
+		}
+		client.RemoveBucket(ctx, bucket)
+	})
+	return endpoint, bucket
+}
+
+func s3StateURI(endpoint string, bucket string, object string) string {
+	return fmt.Sprintf("s3://%s/%s?endpoint=%s&insecure=true", bucket, object, endpoint)
+}
+
+func TestS3StorageMissingObject(t *testing.T) {
+	endpoint, bucket := newMinioBucket(t)
+	storage, err := NewStateStorage(s3StateURI(endpoint, bucket, "cache.json"), DefaultCompression, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := storage.LoadIndex()
+	if err != nil {
+		t.Fatalf("LoadIndex() error = %v", err)
+	}
+	if repositories, _ := index.Repositories(); len(repositories) != 0 {
+		t.Errorf("LoadIndex() of a missing object has %d repositories, want 0", len(repositories))
+	}
+	cache, err := storage.LoadConfigCache()
+	if err != nil {
+		t.Fatalf("LoadConfigCache() error = %v", err)
+	}
+	if cache == nil {
+		t.Error("LoadConfigCache() of a missing object returned no cache")
+	}
+}
+
+func TestS3StorageRoundTrip(t *testing.T) {
+	endpoint, bucket := newMinioBucket(t)
+	location := s3StateURI(endpoint, bucket, "state/cache.json")
+	storage, err := NewStateStorage(location, DefaultCompression, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageRef, err := reference.ParseNamed("registry.example.com/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := NewIndex()
+	saved.ReplaceImage(imageRef.(reference.NamedTagged), &Image{
+		Tag:     "v1",
+		Created: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Labels:  map[string]string{"maintainer": "team"},
+	})
+	if err := storage.SaveIndex(saved); err != nil {
+		t.Fatalf("SaveIndex() error = %v", err)
+	}
+
+	storage, err = NewStateStorage(location, DefaultCompression, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := storage.LoadIndex()
+	if err != nil {
+		t.Fatalf("LoadIndex() error = %v", err)
+	}
+	repository, err := loaded.Repository(reference.TrimNamed(imageRef))
+	if err != nil || repository == nil {
+		t.Fatalf("LoadIndex() lost the repository (error %v)", err)
+	}
+	image := repository.GetImage(imageRef.(reference.NamedTagged))
+	if image == nil || !image.Created.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) || image.Labels["maintainer"] != "team" {
+		t.Errorf("LoadIndex() image = %+v, want the saved image", image)
+	}
+}
+
+func TestS3StorageMissingBucket(t *testing.T) {
+	endpoint, bucket := newMinioBucket(t)
+	_, err := NewStateStorage(s3StateURI(endpoint, bucket+"-missing", "cache.json"), DefaultCompression, context.Background())
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("NewStateStorage() error = %v, want a missing bucket error", err)
+	}
+}
+
+func TestS3StorageJournal(t *testing.T) {
+	endpoint, bucket := newMinioBucket(t)
+	location := s3StateURI(endpoint, bucket, "cache.json")
+	storage, err := NewStateStorage(location, DefaultCompression, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := storage.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageRef, err := reference.ParseNamed("registry.example.com/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.ReplaceImage(imageRef.(reference.NamedTagged), &Image{Tag: "v1"})
+	// Crash without saving the index, once the journal is flushed
+	time.Sleep(2 * journalFlushInterval)
+
+	storage, err = NewStateStorage(location, DefaultCompression, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := storage.LoadIndex()
+	if err != nil {
+		t.Fatalf("LoadIndex() error = %v", err)
+	}
+	repository, _ := recovered.Repository(reference.TrimNamed(imageRef))
+	if repository == nil || repository.GetImage(imageRef.(reference.NamedTagged)) == nil {
+		t.Fatal("LoadIndex() didn't replay the journaled image")
+	}
+
+	// Loading saved the replayed index, and compacted the journal
+	names, err := storage.(*s3Storage).listObjects("cache.json" + journalSuffix + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("journal has segments %v after loading, want none", names)
+	}
+}
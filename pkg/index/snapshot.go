@@ -0,0 +1,110 @@
+package index
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSnapshotInterval is the default interval between snapshots
+	DefaultSnapshotInterval = 5 * time.Minute
+
+	// DefaultSnapshotMutations is the default number of index mutations,
+	// which triggers a snapshot
+	DefaultSnapshotMutations = 1000
+
+	// snapshotCheckInterval is how often the number of mutations is checked
+	snapshotCheckInterval = time.Second
+)
+
+// Snapshotter saves snapshots of the index and the config cache to a
+// StateStorage on an interval, and after a number of index mutations. Zero
+// disables either trigger. Persistent backends only have the config cache
+// saved.
+type Snapshotter struct {
+	storage   StateStorage
+	index     Backend
+	cache     *ConfigCache
+	interval  time.Duration
+	mutations uint64
+
+	lastAttempt          time.Time
+	lastAttemptMutations uint64
+	mutex                sync.Mutex
+}
+
+// NewSnapshotter creates a new Snapshotter
+func NewSnapshotter(storage StateStorage, index Backend, cache *ConfigCache, interval time.Duration, mutations uint64) *Snapshotter {
+	return &Snapshotter{
+		storage:              storage,
+		index:                index,
+		cache:                cache,
+		interval:             interval,
+		mutations:            mutations,
+		lastAttempt:          time.Now(),
+		lastAttemptMutations: index.Mutations(),
+	}
+}
+
+// Snapshot saves a snapshot of the index and the config cache. The
+// triggers of the next snapshot count from this attempt, even if it fails.
+func (s *Snapshotter) Snapshot() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastAttempt = time.Now()
+	s.lastAttemptMutations = s.index.Mutations()
+	if err := s.index.persist(s.storage); err != nil {
+		snapshotFailures.Inc()
+		return err
+	}
+	if err := s.storage.SaveConfigCache(s.cache); err != nil {
+		snapshotFailures.Inc()
+		return err
+	}
+
+	snapshotTimestamp.SetToCurrentTime()
+	return nil
+}
+
+// Serve starts taking snapshots as a background process until the context
+// is cancelled
+func (s *Snapshotter) Serve(ctx context.Context, wg *sync.WaitGroup) {
+	if s.interval <= 0 && s.mutations == 0 {
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(snapshotCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !s.due() {
+					continue
+				}
+				if err := s.Snapshot(); err != nil {
+					log.Printf("[snapshot] Failed to save snapshot: %+v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// due reports whether a snapshot should be taken
+func (s *Snapshotter) due() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.interval > 0 && time.Since(s.lastAttempt) >= s.interval {
+		return true
+	}
+	return s.mutations > 0 && s.index.Mutations()-s.lastAttemptMutations >= s.mutations
+}
@@ -0,0 +1,580 @@
+package index
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// sqliteTimeFormat stores times in UTC as text, which sorts chronologically
+	sqliteTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+	// sqliteBatchSize is the number of images, whose labels are read per query
+	sqliteBatchSize = 500
+)
+
+// sqliteSchema is a normalized schema of the index, which can also be
+// queried directly for reporting
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS repositories (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE
+);
+CREATE TABLE IF NOT EXISTS images (
+	id INTEGER PRIMARY KEY,
+	repository_id INTEGER NOT NULL REFERENCES repositories (id) ON DELETE CASCADE,
+	tag TEXT NOT NULL,
+	digest TEXT NOT NULL,
+	config_digest TEXT NOT NULL,
+	created TEXT NOT NULL,
+	platforms TEXT,
+	UNIQUE (repository_id, tag)
+);
+CREATE INDEX IF NOT EXISTS images_created ON images (repository_id, created);
+CREATE TABLE IF NOT EXISTS labels (
+	image_id INTEGER NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (image_id, key)
+);
+CREATE INDEX IF NOT EXISTS labels_key_value ON labels (key, value);
+CREATE TABLE IF NOT EXISTS digests (
+	image_id INTEGER NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+	digest TEXT NOT NULL,
+	PRIMARY KEY (image_id, digest)
+);
+CREATE INDEX IF NOT EXISTS digests_digest ON digests (digest);
+`
+
+// SQLiteBackend is a Backend and Searcher, which keeps the index in a local
+// SQLite database. Repositories, images, labels and the manifest digests of
+// images and their platforms are stored in normalized tables, so searches
+// use the indexes of the database, and the database can be queried directly
+// for reporting. Every change is committed to the database, so the index
+// isn't saved to a StateStorage and needs no journal.
+type SQLiteBackend struct {
+	db        *sql.DB
+	mutations uint64
+
+	// writeMutex serializes write transactions
+	writeMutex sync.Mutex
+}
+
+// OpenSQLiteBackend opens or creates an index database
+func OpenSQLiteBackend(path string) (*SQLiteBackend, error) {
+	pragmas := url.Values{"_pragma": {"foreign_keys(1)", "journal_mode(WAL)", "busy_timeout(5000)"}}
+	db, err := sql.Open("sqlite", "file:"+path+"?"+pragmas.Encode())
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error opening index database %s", path)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "Error creating index database %s", path)
+	}
+
+	return &SQLiteBackend{
+		db: db,
+	}, nil
+}
+
+// Repository returns a single repository, or nil if it isn't indexed
+func (b *SQLiteBackend) Repository(repositoryRef reference.Named) (*Repository, error) {
+	return querySQLiteRepository(b.db, repositoryRef)
+}
+
+// Repositories returns a summary of all repositories sorted by name
+func (b *SQLiteBackend) Repositories() ([]*RepositorySummary, error) {
+	return querySummaries(b.db, "")
+}
+
+// ForEachImage calls fn for each image in a read transaction, until fn
+// returns an error
+func (b *SQLiteBackend) ForEachImage(fn func(repositoryRef reference.Named, image *Image) error) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer tx.Rollback()
+
+	summaries, err := querySummaries(tx, "")
+	if err != nil {
+		return err
+	}
+	for _, summary := range summaries {
+		images, err := queryImages(tx, `
+			SELECT i.id, i.tag, i.digest, i.config_digest, i.created, i.platforms
+			FROM images i JOIN repositories r ON r.id = i.repository_id
+			WHERE r.name = ?
+			ORDER BY i.created DESC, i.tag`,
+			summary.Name.String(),
+		)
+		if err != nil {
+			return err
+		}
+		for _, image := range images {
+			if err := fn(summary.Name, image); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Search returns the images of a repository matching a query, newest first,
+// or nil if the repository isn't indexed
+func (b *SQLiteBackend) Search(repositoryRef reference.Named, query *ImageQuery, offset int, limit int) (*SearchResult, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer tx.Rollback()
+
+	var repositoryID int64
+	err = tx.QueryRow(`SELECT id FROM repositories WHERE name = ?`, reference.TrimNamed(repositoryRef).String()).Scan(&repositoryID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	conditions := []string{"i.repository_id = ?"}
+	args := []interface{}{repositoryID}
+	if !query.CreatedAfter.IsZero() {
+		conditions = append(conditions, "i.created >= ?")
+		args = append(args, query.CreatedAfter.UTC().Format(sqliteTimeFormat))
+	}
+	if !query.CreatedBefore.IsZero() {
+		conditions = append(conditions, "i.created <= ?")
+		args = append(args, query.CreatedBefore.UTC().Format(sqliteTimeFormat))
+	}
+	for key, value := range query.Labels {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM labels l WHERE l.image_id = i.id AND l.key = ? AND l.value = ?)")
+		args = append(args, key, value)
+	}
+	where := strings.Join(conditions, " AND ")
+
+	result := &SearchResult{}
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM images i WHERE `+where, args...).Scan(&result.Count); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	result.Images, err = queryImages(tx, `
+		SELECT i.id, i.tag, i.digest, i.config_digest, i.created, i.platforms
+		FROM images i
+		WHERE `+where+`
+		ORDER BY i.created DESC, i.tag
+		LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ReplaceRepository atomically replaces a single repository
+func (b *SQLiteBackend) ReplaceRepository(repository *Repository) error {
+	return b.apply(&JournalEntry{
+		Operation:  JournalReplaceRepository,
+		Repository: repository.Name.String(),
+		Images:     repository.Images,
+	})
+}
+
+// ReplaceImage atomically replaces a single image
+func (b *SQLiteBackend) ReplaceImage(imageRef reference.NamedTagged, image *Image) error {
+	return b.apply(&JournalEntry{
+		Operation:  JournalUpsertImage,
+		Repository: reference.TrimNamed(imageRef).String(),
+		Image:      image,
+	})
+}
+
+// DeleteImage deletes an image from a repository
+func (b *SQLiteBackend) DeleteImage(imageRef reference.NamedTagged) error {
+	return b.apply(&JournalEntry{
+		Operation:  JournalDeleteImage,
+		Repository: reference.TrimNamed(imageRef).String(),
+		Tag:        imageRef.Tag(),
+	})
+}
+
+// DeleteDigest atomically deletes every image in a repository with a
+// manifest digest, and returns the deleted tags
+func (b *SQLiteBackend) DeleteDigest(repositoryRef reference.Named, dgst digest.Digest) ([]string, error) {
+	name := reference.TrimNamed(repositoryRef).String()
+	var tags []string
+	err := b.update(func(tx *sql.Tx) (int, error) {
+		rows, err := tx.Query(`
+			SELECT i.tag FROM images i JOIN repositories r ON r.id = i.repository_id
+			WHERE r.name = ? AND i.digest = ?
+			ORDER BY i.tag`,
+			name, dgst.String(),
+		)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		for rows.Next() {
+			var tag string
+			if err := rows.Scan(&tag); err != nil {
+				rows.Close()
+				return 0, errors.WithStack(err)
+			}
+			tags = append(tags, tag)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, errors.WithStack(err)
+		}
+		for _, tag := range tags {
+			err := applySQLiteChange(tx, &JournalEntry{
+				Operation:  JournalDeleteImage,
+				Repository: name,
+				Tag:        tag,
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+		return len(tags), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// Mutations returns the number of times the index has been changed since
+// the database was opened
+func (b *SQLiteBackend) Mutations() uint64 {
+	return atomic.LoadUint64(&b.mutations)
+}
+
+// Close closes the database
+func (b *SQLiteBackend) Close() error {
+	return errors.WithStack(b.db.Close())
+}
+
+func (b *SQLiteBackend) domainRepositories(domain string) ([]reference.Named, error) {
+	summaries, err := querySummaries(b.db, domain+"/")
+	if err != nil {
+		return nil, err
+	}
+	result := make([]reference.Named, len(summaries))
+	for i, summary := range summaries {
+		result[i] = summary.Name
+	}
+	return result, nil
+}
+
+func (b *SQLiteBackend) repositoryImages(repositoryRef reference.Named) (map[string]*Image, error) {
+	repository, err := querySQLiteRepository(b.db, repositoryRef)
+	if err != nil {
+		return nil, err
+	}
+	return imagesByTag(repository), nil
+}
+
+func (b *SQLiteBackend) reconcileRepository(repositoryRef reference.Named, baseline map[string]*Image, crawled *Repository, result *RegistryReconciliation) error {
+	return b.update(func(tx *sql.Tx) (int, error) {
+		repository, err := querySQLiteRepository(tx, repositoryRef)
+		if err != nil {
+			return 0, err
+		}
+		changes := reconcileChanges(repositoryRef, baseline, imagesByTag(repository), crawled, result)
+		for _, change := range changes {
+			if err := applySQLiteChange(tx, change); err != nil {
+				return 0, err
+			}
+		}
+		return len(changes), nil
+	})
+}
+
+// persist does nothing, as every change is committed to the database
+func (b *SQLiteBackend) persist(storage StateStorage) error {
+	return nil
+}
+
+// apply commits a single change
+func (b *SQLiteBackend) apply(change *JournalEntry) error {
+	return b.update(func(tx *sql.Tx) (int, error) {
+		return 1, applySQLiteChange(tx, change)
+	})
+}
+
+// update commits the changes made by fn in a write transaction, and counts
+// the number of changes returned by fn
+func (b *SQLiteBackend) update(fn func(tx *sql.Tx) (int, error)) error {
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	changes, err := fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.WithStack(err)
+	}
+	atomic.AddUint64(&b.mutations, uint64(changes))
+	return nil
+}
+
+// sqliteQuerier is implemented by both sql.DB and sql.Tx
+type sqliteQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// applySQLiteChange applies a change in a write transaction
+func applySQLiteChange(tx *sql.Tx, change *JournalEntry) error {
+	switch change.Operation {
+	case JournalUpsertImage:
+		repositoryID, err := upsertSQLiteRepository(tx, change.Repository)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM images WHERE repository_id = ? AND tag = ?`, repositoryID, change.Image.Tag); err != nil {
+			return errors.WithStack(err)
+		}
+		return insertSQLiteImage(tx, repositoryID, change.Image)
+	case JournalDeleteImage:
+		_, err := tx.Exec(`
+			DELETE FROM images
+			WHERE tag = ? AND repository_id = (SELECT id FROM repositories WHERE name = ?)`,
+			change.Tag, change.Repository,
+		)
+		return errors.WithStack(err)
+	case JournalReplaceRepository:
+		repositoryID, err := upsertSQLiteRepository(tx, change.Repository)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM images WHERE repository_id = ?`, repositoryID); err != nil {
+			return errors.WithStack(err)
+		}
+		for _, image := range change.Images {
+			if err := insertSQLiteImage(tx, repositoryID, image); err != nil {
+				return err
+			}
+		}
+		return nil
+	case JournalDeleteRepository:
+		_, err := tx.Exec(`DELETE FROM repositories WHERE name = ?`, change.Repository)
+		return errors.WithStack(err)
+	default:
+		return errors.Errorf("Unknown operation %q", change.Operation)
+	}
+}
+
+// upsertSQLiteRepository returns the id of a repository, which is created if
+// it doesn't exist
+func upsertSQLiteRepository(tx *sql.Tx, name string) (int64, error) {
+	if _, err := tx.Exec(`INSERT INTO repositories (name) VALUES (?) ON CONFLICT (name) DO NOTHING`, name); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	var id int64
+	err := tx.QueryRow(`SELECT id FROM repositories WHERE name = ?`, name).Scan(&id)
+	return id, errors.WithStack(err)
+}
+
+// insertSQLiteImage inserts an image with its labels and digests
+func insertSQLiteImage(tx *sql.Tx, repositoryID int64, image *Image) error {
+	var platforms []byte
+	if len(image.Platforms) > 0 {
+		var err error
+		if platforms, err = json.Marshal(image.Platforms); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	res, err := tx.Exec(
+		`INSERT INTO images (repository_id, tag, digest, config_digest, created, platforms) VALUES (?, ?, ?, ?, ?, ?)`,
+		repositoryID, image.Tag, image.Digest.String(), image.ConfigDigest.String(),
+		image.Created.UTC().Format(sqliteTimeFormat), platforms,
+	)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	imageID, err := res.LastInsertId()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for key, value := range image.Labels {
+		if _, err := tx.Exec(`INSERT INTO labels (image_id, key, value) VALUES (?, ?, ?)`, imageID, key, value); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	digests := map[digest.Digest]struct{}{}
+	if image.Digest != "" {
+		digests[image.Digest] = struct{}{}
+	}
+	for _, platform := range image.Platforms {
+		if platform.Digest != "" {
+			digests[platform.Digest] = struct{}{}
+		}
+	}
+	for dgst := range digests {
+		if _, err := tx.Exec(`INSERT INTO digests (image_id, digest) VALUES (?, ?)`, imageID, dgst.String()); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// querySummaries returns a summary of the repositories, whose name starts
+// with prefix, sorted by name
+func querySummaries(q sqliteQuerier, prefix string) ([]*RepositorySummary, error) {
+	rows, err := q.Query(`
+		SELECT r.name, COUNT(i.id)
+		FROM repositories r LEFT JOIN images i ON i.repository_id = r.id
+		WHERE substr(r.name, 1, length(?)) = ?
+		GROUP BY r.id
+		ORDER BY r.name`,
+		prefix, prefix,
+	)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	var summaries []*RepositorySummary
+	for rows.Next() {
+		var name string
+		var images int
+		if err := rows.Scan(&name, &images); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		repositoryRef, err := reference.ParseNamed(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid repository %q in index database", name)
+		}
+		summaries = append(summaries, &RepositorySummary{
+			Name:   reference.TrimNamed(repositoryRef),
+			Images: images,
+		})
+	}
+	return summaries, errors.WithStack(rows.Err())
+}
+
+// querySQLiteRepository reads a single repository, or returns nil if it
+// isn't indexed
+func querySQLiteRepository(q sqliteQuerier, repositoryRef reference.Named) (*Repository, error) {
+	repositoryRef = reference.TrimNamed(repositoryRef)
+	images, err := queryImages(q, `
+		SELECT i.id, i.tag, i.digest, i.config_digest, i.created, i.platforms
+		FROM images i JOIN repositories r ON r.id = i.repository_id
+		WHERE r.name = ?`,
+		repositoryRef.String(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		var id int64
+		err := q.QueryRow(`SELECT id FROM repositories WHERE name = ?`, repositoryRef.String()).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return RepositoryFromImages(repositoryRef, images...), nil
+}
+
+// queryImages runs a query selecting the id, tag, digest, config_digest,
+// created and platforms columns of images, and reads the images with their
+// labels
+func queryImages(q sqliteQuerier, query string, args ...interface{}) ([]*Image, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	images := make([]*Image, 0)
+	var ids []interface{}
+	for rows.Next() {
+		var id int64
+		var image Image
+		var created string
+		var platforms []byte
+		if err := rows.Scan(&id, &image.Tag, &image.Digest, &image.ConfigDigest, &created, &platforms); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if image.Created, err = time.Parse(sqliteTimeFormat, created); err != nil {
+			return nil, errors.Wrapf(err, "Invalid creation time of image %s", image.Tag)
+		}
+		if len(platforms) > 0 {
+			if err := json.Unmarshal(platforms, &image.Platforms); err != nil {
+				return nil, errors.Wrapf(err, "Invalid platforms of image %s", image.Tag)
+			}
+		}
+		images = append(images, &image)
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(images) == 0 {
+		return images, nil
+	}
+
+	imageByID := make(map[int64]*Image, len(images))
+	for n, id := range ids {
+		imageByID[id.(int64)] = images[n]
+	}
+	for start := 0; start < len(ids); start += sqliteBatchSize {
+		end := start + sqliteBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := queryLabels(q, imageByID, ids[start:end]); err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// queryLabels reads the labels of a batch of images
+func queryLabels(q sqliteQuerier, imageByID map[int64]*Image, ids []interface{}) error {
+	rows, err := q.Query(
+		`SELECT image_id, key, value FROM labels WHERE image_id IN (`+strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")+`)`,
+		ids...,
+	)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var key, value string
+		if err := rows.Scan(&id, &key, &value); err != nil {
+			return errors.WithStack(err)
+		}
+		image := imageByID[id]
+		if image.Labels == nil {
+			image.Labels = make(map[string]string)
+		}
+		image.Labels[key] = value
+	}
+	return errors.WithStack(rows.Err())
+}
@@ -0,0 +1,194 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// StateFormat identifies registryindexer state files
+	StateFormat = "registryindexer-state"
+
+	// StateFormatVersion is the version of the state file format written by
+	// this version of registryindexer. Version 1 is the legacy format of a
+	// bare, uncompressed JSON document.
+	StateFormatVersion = 2
+)
+
+// WriterVersion is the registryindexer version recorded in state files. It
+// can be set at build time with
+// -ldflags "-X github.com/parmus/registryindexer/pkg/index.WriterVersion=<version>",
+// and otherwise defaults to the module version of the build.
+var WriterVersion string
+
+// statePrefix is the beginning of every state file in format version 2 and later
+var statePrefix = []byte(`{"format":"` + StateFormat + `"`)
+
+// Compression is a compression algorithm for state payloads
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+
+	// DefaultCompression is the default compression of state payloads
+	DefaultCompression = CompressionZstd
+)
+
+// ParseCompression parses the name of a compression algorithm. An empty
+// name is the default compression.
+func ParseCompression(name string) (Compression, error) {
+	switch compression := Compression(name); compression {
+	case "":
+		return DefaultCompression, nil
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return compression, nil
+	default:
+		return "", errors.Errorf("Unknown state compression %q", name)
+	}
+}
+
+// StateHeader is the first line of a state file. It describes the
+// compressed JSON payload following it.
+type StateHeader struct {
+	Format      string        `json:"format"`
+	Version     int           `json:"version"`
+	Writer      string        `json:"writer"`
+	Created     time.Time     `json:"created"`
+	Registries  []string      `json:"registries,omitempty"`
+	Compression Compression   `json:"compression"`
+	Checksum    digest.Digest `json:"checksum"`
+}
+
+// encodeState writes v as a state file, with a header covering registries
+func encodeState(w io.Writer, v interface{}, registries []string, compression Compression) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	header, err := json.Marshal(StateHeader{
+		Format:      StateFormat,
+		Version:     StateFormatVersion,
+		Writer:      writerVersion(),
+		Created:     time.Now().UTC(),
+		Registries:  registries,
+		Compression: compression,
+		Checksum:    digest.FromBytes(payload),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := w.Write(append(header, '\n')); err != nil {
+		return errors.WithStack(err)
+	}
+
+	var compressor io.WriteCloser
+	switch compression {
+	case CompressionNone:
+		_, err := w.Write(payload)
+		return errors.WithStack(err)
+	case CompressionGzip:
+		compressor = gzip.NewWriter(w)
+	case CompressionZstd:
+		if compressor, err = zstd.NewWriter(w); err != nil {
+			return errors.WithStack(err)
+		}
+	default:
+		return errors.Errorf("Unknown state compression %q", compression)
+	}
+	if _, err := compressor.Write(payload); err != nil {
+		compressor.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(compressor.Close())
+}
+
+// decodeState reads a state file into v. State files in older formats are
+// migrated, while state files in newer formats are refused.
+func decodeState(r io.Reader, v interface{}) error {
+	reader := bufio.NewReader(r)
+	prefix, err := reader.Peek(len(statePrefix))
+	if err != nil && err != io.EOF {
+		return errors.WithStack(err)
+	}
+	if !bytes.Equal(prefix, statePrefix) {
+		log.Printf("Migrating state from format version 1")
+		return errors.WithStack(json.NewDecoder(reader).Decode(v))
+	}
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return errors.Wrap(err, "Error reading state header")
+	}
+	var header StateHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return errors.Wrap(err, "Invalid state header")
+	}
+	if header.Version > StateFormatVersion {
+		return errors.Errorf(
+			"State was written by registryindexer %s in format version %d, but only format versions up to %d are supported. Upgrade registryindexer or remove the state.",
+			header.Writer, header.Version, StateFormatVersion,
+		)
+	}
+	if err := header.Checksum.Validate(); err != nil {
+		return errors.Wrap(err, "Invalid state checksum")
+	}
+
+	var payload io.Reader
+	switch header.Compression {
+	case CompressionNone:
+		payload = reader
+	case CompressionGzip:
+		decompressor, err := gzip.NewReader(reader)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer decompressor.Close()
+		payload = decompressor
+	case CompressionZstd:
+		decompressor, err := zstd.NewReader(reader)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer decompressor.Close()
+		payload = decompressor
+	default:
+		return errors.Errorf("Unknown state compression %q", header.Compression)
+	}
+
+	verifier := header.Checksum.Verifier()
+	payload = io.TeeReader(payload, verifier)
+	if err := json.NewDecoder(payload).Decode(v); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := io.Copy(io.Discard, payload); err != nil {
+		return errors.WithStack(err)
+	}
+	if !verifier.Verified() {
+		return errors.New("State checksum mismatch")
+	}
+	return nil
+}
+
+// writerVersion returns the registryindexer version recorded in state files
+func writerVersion() string {
+	if WriterVersion != "" {
+		return WriterVersion
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return "unknown"
+}
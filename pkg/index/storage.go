@@ -2,22 +2,41 @@ package index
 
 import (
 	"context"
-	"encoding/json"
+	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	"cloud.google.com/go/storage"
 	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 )
 
+// StateStorage persists the index, and the config cache alongside it.
+//
+// A StateStorage keeps a journal of the changes to the index since it was
+// last saved, next to the state. Loading the index replays the journal, and
+// saving the index compacts it.
 type StateStorage interface {
 	LoadIndex() (*Index, error)
 	SaveIndex(*Index) error
+	LoadConfigCache() (*ConfigCache, error)
+	SaveConfigCache(*ConfigCache) error
 }
 
-func NewStateStorage(stateFile string, ctx context.Context) (StateStorage, error) {
+// configCacheSuffix is appended to the state location to get the location
+// of the config cache
+const configCacheSuffix = ".configs"
+
+// NewStateStorage creates a StateStorage for a state file path or URI, which
+// compresses the state with compression
+func NewStateStorage(stateFile string, compression Compression, ctx context.Context) (StateStorage, error) {
 	if stateFile == "" {
 		return &nullStorage{}, nil
 	}
@@ -27,14 +46,47 @@ func NewStateStorage(stateFile string, ctx context.Context) (StateStorage, error
 	}
 	switch uri.Scheme {
 	case "":
-		return newFileStorage(uri)
+		return newFileStorage(uri, compression)
 	case "gs":
-		return newGcsStorage(uri, ctx)
+		return newGcsStorage(uri, compression, ctx)
+	case "s3":
+		return newS3Storage(uri, compression, ctx)
 	default:
 		return nil, errors.New("Unknown cache URI type")
 	}
 }
 
+// NewReadOnlyStateStorage creates a StateStorage for a state file path or
+// URI, which loads the state without changing it, and refuses to save it
+func NewReadOnlyStateStorage(stateFile string, ctx context.Context) (StateStorage, error) {
+	storage, err := NewStateStorage(stateFile, DefaultCompression, ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch storage := storage.(type) {
+	case *fileStorage:
+		storage.readOnly = true
+	case *gcsStorage:
+		storage.readOnly = true
+	case *s3Storage:
+		storage.readOnly = true
+	}
+	return &readOnlyStorage{storage}, nil
+}
+
+// readOnlyStorage refuses to save the state
+type readOnlyStorage struct {
+	StateStorage
+}
+
+func (c *readOnlyStorage) SaveIndex(index *Index) error {
+	return errors.New("State storage is read-only")
+}
+
+func (c *readOnlyStorage) SaveConfigCache(cache *ConfigCache) error {
+	return errors.New("State storage is read-only")
+}
+
 // nullStorage
 type nullStorage struct{}
 
@@ -46,53 +98,168 @@ func (c *nullStorage) SaveIndex(index *Index) error {
 	return nil
 }
 
-// fileStorage
+func (c *nullStorage) LoadConfigCache() (*ConfigCache, error) {
+	return NewConfigCache(), nil
+}
+
+func (c *nullStorage) SaveConfigCache(cache *ConfigCache) error {
+	return nil
+}
+
+// fileStorage keeps a journal in a file next to the state file. A read-only
+// fileStorage replays the journal, but leaves it uncompacted.
 type fileStorage struct {
-	path string
+	path        string
+	compression Compression
+	journal     *fileJournal
+	readOnly    bool
 }
 
-func newFileStorage(uri *url.URL) (*fileStorage, error) {
+func newFileStorage(uri *url.URL, compression Compression) (*fileStorage, error) {
 	return &fileStorage{
-		path: uri.Path,
+		path:        uri.Path,
+		compression: compression,
+		journal:     newFileJournal(uri.Path + journalSuffix),
 	}, nil
 }
 
 func (c *fileStorage) LoadIndex() (*Index, error) {
 	index := NewIndex()
+	if err := c.loadIndex(index); err != nil {
+		return nil, err
+	}
+	return loadJournal(c, index, c.journal, c.readOnly)
+}
+
+// loadJournal replays a journal over an index loaded from a storage. Unless
+// the storage is read-only, the index is saved if changes were replayed, and
+// further changes of the index are appended to the journal.
+func loadJournal(storage StateStorage, index *Index, journal Journal, readOnly bool) (*Index, error) {
+	replayed, err := index.replay(journal)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error replaying journal")
+	}
+	if readOnly {
+		return index, nil
+	}
+	if replayed > 0 {
+		log.Printf("Replayed %d journaled changes", replayed)
+		if err := storage.SaveIndex(index); err != nil {
+			return nil, err
+		}
+	} else if err := journal.Compact(index.Mutations()); err != nil {
+		return nil, errors.Wrap(err, "Error compacting journal")
+	}
+	index.journal = journal
+	return index, nil
+}
+
+func (c *fileStorage) loadIndex(index *Index) error {
 	inputFile, err := os.Open(c.path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return index, nil
+			return nil
 		}
-		return nil, errors.WithStack(err)
+		return errors.WithStack(err)
 	}
 
-	if err := json.NewDecoder(inputFile).Decode(&index); err != nil {
-		return nil, errors.WithStack(err)
+	if err := decodeState(inputFile, index); err != nil {
+		inputFile.Close()
+		return err
 	}
-	return index, inputFile.Close()
+	return errors.WithStack(inputFile.Close())
 }
 
 func (c *fileStorage) SaveIndex(index *Index) error {
 	log.Println("Saving cached index")
-	f, err := os.Create(c.path)
+	snapshot := index.Snapshot()
+	err := writeFileAtomic(c.path, func(w io.Writer) error {
+		return encodeState(w, snapshot, snapshot.Registries(), c.compression)
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(c.journal.Compact(snapshot.Mutations()), "Error compacting journal")
+}
+
+func (c *fileStorage) LoadConfigCache() (*ConfigCache, error) {
+	cache := NewConfigCache()
+	inputFile, err := os.Open(c.path + configCacheSuffix)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return cache, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	if err := decodeState(inputFile, cache); err != nil {
+		inputFile.Close()
+		return nil, err
+	}
+	return cache, inputFile.Close()
+}
+
+func (c *fileStorage) SaveConfigCache(cache *ConfigCache) error {
+	log.Println("Saving config cache")
+	return writeFileAtomic(c.path+configCacheSuffix, func(w io.Writer) error {
+		return encodeState(w, cache, nil, c.compression)
+	})
+}
+
+// writeFileAtomic replaces a file with the output of write. The output is
+// written to a temporary file in the same directory, which is synced and
+// renamed over the file, so a crash never leaves a partially written file.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+name+".tmp-*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(f.Name())
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
 		return errors.WithStack(err)
 	}
-	err = json.NewEncoder(f).Encode(index)
+	if err := f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Sync the directory to persist the rename
+	d, err := os.Open(dir)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	return f.Close()
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(d.Close())
 }
 
-// gcsStorage
+// gcsStorage keeps the state in a GCS object, and a journal in segment
+// objects next to it
 type gcsStorage struct {
-	ctx    context.Context
-	object *storage.ObjectHandle
+	ctx         context.Context
+	bucket      *storage.BucketHandle
+	object      *gcsObject
+	cacheObject *gcsObject
+	compression Compression
+	journal     *objectJournal
+	readOnly    bool
 }
 
-func newGcsStorage(uri *url.URL, ctx context.Context) (*gcsStorage, error) {
+func newGcsStorage(uri *url.URL, compression Compression, ctx context.Context) (*gcsStorage, error) {
 	client, err := storage.NewClient(ctx)
 	if err != nil {
 		return nil, err
@@ -105,43 +272,161 @@ func newGcsStorage(uri *url.URL, ctx context.Context) (*gcsStorage, error) {
 		}
 	}
 
-	object := bucket.Object(strings.TrimLeft(uri.Path, "/"))
+	objectName := strings.TrimLeft(uri.Path, "/")
 
-	return &gcsStorage{
-		ctx:    ctx,
-		object: object,
-	}, nil
+	gcs := &gcsStorage{
+		ctx:         ctx,
+		bucket:      bucket,
+		object:      &gcsObject{handle: bucket.Object(objectName)},
+		cacheObject: &gcsObject{handle: bucket.Object(objectName + configCacheSuffix)},
+		compression: compression,
+	}
+	gcs.journal = newObjectJournal(gcs, objectName+journalSuffix+"/")
+	return gcs, nil
 }
 
 func (c *gcsStorage) LoadIndex() (*Index, error) {
 	index := NewIndex()
+	if err := c.object.load(c.ctx, index); err != nil {
+		return nil, err
+	}
+	return loadJournal(c, index, c.journal, c.readOnly)
+}
 
-	reader, err := c.object.NewReader(c.ctx)
+func (c *gcsStorage) SaveIndex(index *Index) error {
+	snapshot := index.Snapshot()
+	if err := c.object.save(c.ctx, snapshot, snapshot.Registries(), c.compression); err != nil {
+		return err
+	}
+	return errors.Wrap(c.journal.Compact(snapshot.Mutations()), "Error compacting journal")
+}
+
+func (c *gcsStorage) LoadConfigCache() (*ConfigCache, error) {
+	cache := NewConfigCache()
+	if err := c.cacheObject.load(c.ctx, cache); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+func (c *gcsStorage) SaveConfigCache(cache *ConfigCache) error {
+	return c.cacheObject.save(c.ctx, cache, nil, c.compression)
+}
+
+func (c *gcsStorage) putObject(name string, data []byte) error {
+	writer := c.bucket.Object(name).NewWriter(c.ctx)
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(writer.Close())
+}
+
+func (c *gcsStorage) getObject(name string) ([]byte, error) {
+	reader, err := c.bucket.Object(name).NewReader(c.ctx)
 	if err != nil {
-		if err == storage.ErrObjectNotExist {
-			return index, nil
-		}
 		return nil, errors.WithStack(err)
 	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	return data, errors.WithStack(err)
+}
 
-	if err := json.NewDecoder(reader).Decode(&index); err != nil {
-		return nil, errors.WithStack(err)
+func (c *gcsStorage) listObjects(prefix string) ([]string, error) {
+	var names []string
+	objects := c.bucket.Objects(c.ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		names = append(names, attrs.Name)
 	}
-	return index, reader.Close()
+	sort.Strings(names)
+	return names, nil
 }
 
-func (c *gcsStorage) SaveIndex(index *Index) error {
-	writer := c.object.NewWriter(c.ctx)
-	if err := json.NewEncoder(writer).Encode(&index); err != nil {
+func (c *gcsStorage) deleteObject(name string) error {
+	if err := c.bucket.Object(name).Delete(c.ctx); err != nil && err != storage.ErrObjectNotExist {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// gcsObject is a state object in GCS. It remembers the generation of the
+// object when it was last loaded or saved, and saves with a generation
+// precondition, so a save fails instead of overwriting the state of another
+// writer.
+type gcsObject struct {
+	handle     *storage.ObjectHandle
+	generation int64
+	loaded     bool
+	mutex      sync.Mutex
+}
+
+// load decodes the object into v. A missing object leaves v untouched.
+func (o *gcsObject) load(ctx context.Context, v interface{}) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	reader, err := o.handle.NewReader(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			o.generation = 0
+			o.loaded = true
+			return nil
+		}
 		return errors.WithStack(err)
 	}
+
+	if err := decodeState(reader, v); err != nil {
+		reader.Close()
+		return err
+	}
+	o.generation = reader.Attrs.Generation
+	o.loaded = true
+	return errors.WithStack(reader.Close())
+}
+
+// save encodes v into the object, with a header covering registries
+func (o *gcsObject) save(ctx context.Context, v interface{}, registries []string, compression Compression) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	handle := o.handle
+	if o.loaded {
+		if o.generation == 0 {
+			handle = handle.If(storage.Conditions{DoesNotExist: true})
+		} else {
+			handle = handle.If(storage.Conditions{GenerationMatch: o.generation})
+		}
+	}
+
+	// Closing the writer commits the object, so a failed encoding cancels the
+	// upload instead, and leaves the last saved object in place
+	writerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := handle.NewWriter(writerCtx)
+	if err := encodeState(writer, v, registries, compression); err != nil {
+		cancel()
+		return err
+	}
 	err := writer.Close()
 	if err != nil {
 		if err == storage.ErrBucketNotExist {
-			return errors.Wrapf(err, "Bucket %s does not exist", c.object.BucketName())
+			return errors.Wrapf(err, "Bucket %s does not exist", o.handle.BucketName())
+		}
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+			return errors.Wrapf(err, "Object %s was changed by another writer", o.handle.ObjectName())
 		}
 		return errors.WithStack(err)
 	}
 
+	o.generation = writer.Attrs().Generation
+	o.loaded = true
 	return nil
 }
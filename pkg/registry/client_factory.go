@@ -2,9 +2,11 @@
 package registry
 
 import (
+	"net"
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/reference"
@@ -36,6 +38,11 @@ type ClientFactory interface {
 	// GetRepository creates a distribution.Repository for a specific repository.
 	// GetRepository is memoized and safe to call naively whenever needed.
 	GetRepository(reference.Named) (distribution.Repository, error)
+
+	// GetRepositoryTransport creates a http.RoundTripper authenticated for pulling
+	// from a specific repository. GetRepositoryTransport is memoized and safe to
+	// call naively whenever needed.
+	GetRepositoryTransport(reference.Named) (http.RoundTripper, error)
 }
 
 type clientFactory struct {
@@ -47,16 +54,35 @@ type clientFactory struct {
 	// memoized instances
 	registry     client.Registry
 	repositories map[reference.Named]distribution.Repository
+	transports   map[reference.Named]http.RoundTripper
 
 	// Mutex
 	mutex sync.Mutex
 }
 
 // NewClientFactory produces a new ClientFactory
-func NewClientFactory(baseURL *url.URL, concurrency int, credentialStore auth.CredentialStore) (ClientFactory, error) {
-	baseTransport := registry.NewTransport(nil)
-	baseTransport.MaxConnsPerHost = concurrency
-	baseTransport.DisableKeepAlives = false
+func NewClientFactory(baseURL *url.URL, credentialStore auth.CredentialStore, options Options) (ClientFactory, error) {
+	httpTransport := registry.NewTransport(nil)
+	httpTransport.MaxConnsPerHost = options.Concurrency
+	httpTransport.DisableKeepAlives = false
+	if options.ConnectTimeout > 0 {
+		httpTransport.DialContext = (&net.Dialer{
+			Timeout:   options.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		httpTransport.TLSHandshakeTimeout = options.ConnectTimeout
+	}
+	// Token requests made by the authorizer don't carry a context, so this
+	// is what bounds them
+	httpTransport.ResponseHeaderTimeout = options.RequestTimeout
+
+	baseTransport := newRateLimitedTransport(
+		httpTransport,
+		baseURL.Hostname(),
+		options.RequestsPerSecond,
+		options.Burst,
+		options.MaxRetries,
+	)
 
 	challengeManager, foundV2, err := registry.PingV2Registry(baseURL, baseTransport)
 	if err != nil {
@@ -80,6 +106,7 @@ func NewClientFactory(baseURL *url.URL, concurrency int, credentialStore auth.Cr
 		tokenHandlerOptions: tokenHandlerOptions,
 		registry:            nil,
 		repositories:        make(map[reference.Named]distribution.Repository),
+		transports:          make(map[reference.Named]http.RoundTripper),
 	}, nil
 }
 
@@ -107,25 +134,16 @@ func (f *clientFactory) GetRepository(repositoryName reference.Named) (distribut
 	var ok bool
 	var repository distribution.Repository
 
-	if reference.Domain(repositoryName) != f.baseURL.Hostname() {
-		return nil, errors.Errorf("Domain name mismatch: %v does not belong in %v", repositoryName, f.baseURL)
-	}
-
-	repositoryName, err = reference.WithName(reference.Path(repositoryName))
+	repositoryName, err = f.repositoryPath(repositoryName)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
 
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 	if repository, ok = f.repositories[repositoryName]; !ok {
-		scope := auth.RepositoryScope{
-			Repository: repositoryName.String(),
-			Actions:    []string{"pull"},
-		}
-
 		var err error
-		repository, err = client.NewRepository(repositoryName, f.baseURL.String(), f.GetTransport(scope))
+		repository, err = client.NewRepository(repositoryName, f.baseURL.String(), f.getRepositoryTransport(repositoryName))
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
@@ -133,3 +151,42 @@ func (f *clientFactory) GetRepository(repositoryName reference.Named) (distribut
 	}
 	return repository, nil
 }
+
+func (f *clientFactory) GetRepositoryTransport(repositoryName reference.Named) (http.RoundTripper, error) {
+	repositoryName, err := f.repositoryPath(repositoryName)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.getRepositoryTransport(repositoryName), nil
+}
+
+// getRepositoryTransport must be called with the mutex held
+func (f *clientFactory) getRepositoryTransport(repositoryName reference.Named) http.RoundTripper {
+	transport, ok := f.transports[repositoryName]
+	if !ok {
+		scope := auth.RepositoryScope{
+			Repository: repositoryName.String(),
+			Actions:    []string{"pull"},
+		}
+		transport = f.GetTransport(scope)
+		f.transports[repositoryName] = transport
+	}
+	return transport
+}
+
+// repositoryPath strips the domain from a repository name, after verifying
+// that the repository belongs in this registry
+func (f *clientFactory) repositoryPath(repositoryName reference.Named) (reference.Named, error) {
+	if reference.Domain(repositoryName) != f.baseURL.Host {
+		return nil, errors.Errorf("Domain name mismatch: %v does not belong in %v", repositoryName, f.baseURL)
+	}
+
+	repositoryName, err := reference.WithName(reference.Path(repositoryName))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return repositoryName, nil
+}
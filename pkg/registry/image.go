@@ -0,0 +1,24 @@
+package registry
+
+import (
+	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// Image is an image manifest resolved to the image configs of all of its
+// platforms. A single-platform manifest resolves to exactly one config.
+type Image struct {
+	MediaType string
+	Digest    digest.Digest
+	Configs   []*ImageConfig
+}
+
+// ImageConfig is the image config of a single platform
+type ImageConfig struct {
+	ManifestDigest digest.Digest
+	ConfigDigest   digest.Digest
+	OS             string
+	Architecture   string
+	Variant        string
+	Image          *types.ImageInspect
+}
@@ -0,0 +1,49 @@
+package registry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	catalogPages = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "registryindexer",
+			Name:      "catalog_pages",
+			Help:      "Number of catalog pages crawled during the last catalog crawl",
+		},
+		[]string{"registry"},
+	)
+	catalogRepositories = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "registryindexer",
+			Name:      "catalog_repositories",
+			Help:      "Number of repositories crawled during the last catalog crawl, before prefix filtering",
+		},
+		[]string{"registry"},
+	)
+	tagPages = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "tag_pages_total",
+			Help:      "Total number of tag list pages crawled",
+		},
+		[]string{"registry"},
+	)
+	registryThrottled = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "registryindexer",
+			Name:      "registry_throttled_total",
+			Help:      "Total number of throttled registry requests",
+		},
+		[]string{"registry", "code"},
+	)
+	registryRequestRate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "registryindexer",
+			Name:      "registry_request_rate",
+			Help:      "Current request budget in requests per second, after adaptive backoff",
+		},
+		[]string{"registry"},
+	)
+)
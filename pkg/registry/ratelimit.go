@@ -0,0 +1,179 @@
+package registry
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultMaxRetries is the default number of retries of throttled requests
+	DefaultMaxRetries = 5
+
+	// initialBackoff is the backoff before the first retry of a throttled request
+	initialBackoff = 500 * time.Millisecond
+
+	// maxBackoff caps the exponential backoff and the Retry-After delay
+	// between retries
+	maxBackoff = 60 * time.Second
+
+	// minRateFactor is the lowest fraction of the configured request rate the
+	// adaptive rate limit will back off to
+	minRateFactor = 0.1
+)
+
+// rateLimitedTransport is a http.RoundTripper which spends a request budget
+// per registry, and retries throttled requests.
+//
+// Every request waits for a token from a token bucket. Responses with status
+// 429 or 503 are retried after the delay requested in the Retry-After header,
+// or after an exponential backoff with jitter if no delay was requested. Both
+// are capped at maxBackoff, so a registry can't stall a crawl indefinitely.
+// Throttled responses also halve the request rate, which then recovers
+// gradually with every successful request.
+type rateLimitedTransport struct {
+	transport  http.RoundTripper
+	registry   string
+	limiter    *rate.Limiter
+	maxRate    rate.Limit
+	maxRetries int
+
+	mutex sync.Mutex
+}
+
+// newRateLimitedTransport wraps a http.RoundTripper in a rateLimitedTransport.
+// A zero requestsPerSecond disables the token bucket, but keeps the retries.
+func newRateLimitedTransport(transport http.RoundTripper, registry string, requestsPerSecond float64, burst int, maxRetries int) *rateLimitedTransport {
+	var limiter *rate.Limiter
+	if requestsPerSecond > 0 {
+		if burst < 1 {
+			burst = int(math.Max(1, math.Ceil(requestsPerSecond)))
+		}
+		limiter = rate.NewLimiter(rate.Limit(requestsPerSecond), burst)
+	}
+
+	return &rateLimitedTransport{
+		transport:  transport,
+		registry:   registry,
+		limiter:    limiter,
+		maxRate:    rate.Limit(requestsPerSecond),
+		maxRetries: maxRetries,
+	}
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if t.limiter != nil {
+			if err := t.limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := t.transport.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+			t.relax()
+			return resp, nil
+		}
+
+		registryThrottled.WithLabelValues(t.registry, strconv.Itoa(resp.StatusCode)).Inc()
+		t.throttle()
+		if attempt >= t.maxRetries || !rewindable(req) {
+			return resp, nil
+		}
+
+		delay, ok := retryAfter(resp.Header.Get("Retry-After"))
+		if !ok {
+			delay = backoff(attempt)
+		}
+		resp.Body.Close()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// throttle halves the request rate, down to minRateFactor of the configured rate
+func (t *rateLimitedTransport) throttle() {
+	if t.limiter == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.limiter.SetLimit(rate.Limit(math.Max(float64(t.limiter.Limit())/2, float64(t.maxRate)*minRateFactor)))
+	registryRequestRate.WithLabelValues(t.registry).Set(float64(t.limiter.Limit()))
+}
+
+// relax raises the request rate by a small step towards the configured rate
+func (t *rateLimitedTransport) relax() {
+	if t.limiter == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.limiter.Limit() >= t.maxRate {
+		return
+	}
+	t.limiter.SetLimit(rate.Limit(math.Min(float64(t.limiter.Limit())+float64(t.maxRate)*minRateFactor/10, float64(t.maxRate))))
+	registryRequestRate.WithLabelValues(t.registry).Set(float64(t.limiter.Limit()))
+}
+
+// rewindable reports whether a request can safely be sent again
+func rewindable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// retryAfter parses a Retry-After header, which is either a number of
+// seconds or a HTTP date. The delay is capped at maxBackoff.
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds >= 0 {
+		if seconds > int64(maxBackoff/time.Second) {
+			return maxBackoff, true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		if delay > maxBackoff {
+			delay = maxBackoff
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// backoff returns an exponential backoff with jitter for a retry attempt
+func backoff(attempt int) time.Duration {
+	delay := maxBackoff
+	if attempt < 16 {
+		delay = time.Duration(math.Min(float64(initialBackoff<<attempt), float64(maxBackoff)))
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -2,44 +2,106 @@
 package registry
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/parmus/registryindexer/internal/utils"
 	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/ocischema"
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/docker/distribution/reference"
+	v2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/docker/distribution/registry/client"
 	"github.com/docker/distribution/registry/client/auth"
 	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
 
+// PageSize is the number of entries requested per page from paginated endpoints
+const PageSize = 1000
+
+// ManifestMediaTypes are the manifest media types accepted from the registry
+var ManifestMediaTypes = []string{
+	schema2.MediaTypeManifest,
+	manifestlist.MediaTypeManifestList,
+	v1.MediaTypeImageManifest,
+	v1.MediaTypeImageIndex,
+}
+
 // Registry is a simple HTTP client for Docker Registry. This client only
 // subset of the Docker Registry API endpoints.
 type Registry struct {
-	ctx           context.Context
-	baseURL       *url.URL
-	prefixes      []string
-	clientFactory ClientFactory
+	baseURL        *url.URL
+	prefixes       []string
+	clientFactory  ClientFactory
+	urlBuilder     *v2.URLBuilder
+	requestTimeout time.Duration
+}
+
+// Options contains the tuning options for a Registry client
+type Options struct {
+	// Concurrency is the maximum number of concurrent connections to the registry
+	Concurrency int
+
+	// RequestsPerSecond is the request budget for the registry. Zero means unlimited.
+	RequestsPerSecond float64
+
+	// Burst is the number of requests, which may exceed the request budget
+	Burst int
+
+	// MaxRetries is the number of times a throttled request is retried
+	MaxRetries int
+
+	// ConnectTimeout limits the time spent on establishing a connection,
+	// including the TLS handshake
+	ConnectTimeout time.Duration
+
+	// RequestTimeout limits the time spent on a single request, including
+	// reading the response
+	RequestTimeout time.Duration
+}
+
+// DefaultOptions returns the default Options
+func DefaultOptions() Options {
+	return Options{
+		Concurrency:    50,
+		MaxRetries:     DefaultMaxRetries,
+		ConnectTimeout: 30 * time.Second,
+		RequestTimeout: 60 * time.Second,
+	}
 }
 
 // NewRegistry creates a new Registry client.
-func NewRegistry(baseURL *url.URL, prefixes []string, concurrency int, credentialStore auth.CredentialStore) (*Registry, error) {
-	clientFactory, err := NewClientFactory(baseURL, concurrency, credentialStore)
+func NewRegistry(baseURL *url.URL, prefixes []string, credentialStore auth.CredentialStore, options Options) (*Registry, error) {
+	clientFactory, err := NewClientFactory(baseURL, credentialStore, options)
 	if err != nil {
 		return nil, err
 	}
 
+	urlBuilder, err := v2.NewURLBuilderFromString(baseURL.String(), false)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
 	return &Registry{
-		ctx:           context.Background(),
-		baseURL:       baseURL,
-		prefixes:      prefixes,
-		clientFactory: clientFactory,
+		baseURL:        baseURL,
+		prefixes:       prefixes,
+		clientFactory:  clientFactory,
+		urlBuilder:     urlBuilder,
+		requestTimeout: options.RequestTimeout,
 	}, nil
 }
 
@@ -47,24 +109,39 @@ func (r *Registry) Hostname() string {
 	return r.baseURL.Hostname()
 }
 
-// GetCatalog returns a list of all repositories
-func (r *Registry) GetCatalog() ([]reference.Named, error) {
-	repositoryNames := make([]string, 1000)
+// Domain returns the domain of the names of repositories in the registry,
+// which includes the port of a registry on a non-default port
+func (r *Registry) Domain() string {
+	return r.baseURL.Host
+}
 
-	registry, err := r.clientFactory.GetRegistry()
+// GetCatalog returns a list of all repositories
+func (r *Registry) GetCatalog(ctx context.Context) ([]reference.Named, error) {
+	catalogURL, err := r.urlBuilder.BuildCatalogURL(url.Values{"n": []string{strconv.Itoa(PageSize)}})
 	if err != nil {
-		return nil, err
-	}
-
-	n, err := registry.Repositories(r.ctx, repositoryNames, "")
-	if err != nil && err != io.EOF {
 		return nil, errors.WithStack(err)
 	}
-	refs := make([]reference.Named, 0, n)
-	for i, repositoryName := range repositoryNames {
-		if i == n {
-			break
+
+	repositoryNames := make([]string, 0)
+	stats, err := r.getPaginated(ctx, r.clientFactory.GetTransport(), catalogURL, func(body io.Reader) (int, error) {
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		if err := json.NewDecoder(body).Decode(&page); err != nil {
+			return 0, err
 		}
+		repositoryNames = append(repositoryNames, page.Repositories...)
+		return len(page.Repositories), nil
+	})
+	catalogPages.WithLabelValues(r.Hostname()).Set(float64(stats.Pages))
+	catalogRepositories.WithLabelValues(r.Hostname()).Set(float64(stats.Entries))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Catalog crawl of %v incomplete after %d pages and %d repositories", r.baseURL, stats.Pages, stats.Entries)
+	}
+	log.Printf("Crawled catalog of %v: %d repositories in %d pages", r.baseURL, stats.Entries, stats.Pages)
+
+	refs := make([]reference.Named, 0, len(repositoryNames))
+	for _, repositoryName := range repositoryNames {
 		ref, err := reference.WithName(path.Join(r.baseURL.Host, repositoryName))
 		if err != nil {
 			return nil, fmt.Errorf("could not parse %s as a valid reference: %s", repositoryName, err)
@@ -81,16 +158,37 @@ func (r *Registry) GetCatalog() ([]reference.Named, error) {
 }
 
 // GetTags returns a list of all tags for a repository
-func (r *Registry) GetTags(repositoryName reference.Named) ([]reference.NamedTagged, error) {
-	repository, err := r.clientFactory.GetRepository(repositoryName)
+func (r *Registry) GetTags(ctx context.Context, repositoryName reference.Named) ([]reference.NamedTagged, error) {
+	transport, err := r.clientFactory.GetRepositoryTransport(repositoryName)
 	if err != nil {
 		return nil, err
 	}
 
-	tags, err := repository.Tags(r.ctx).All(r.ctx)
+	pathName, err := reference.WithName(reference.Path(repositoryName))
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	tagsURL, err := r.urlBuilder.BuildTagsURL(pathName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	tagsURL = tagsURL + "?" + url.Values{"n": []string{strconv.Itoa(PageSize)}}.Encode()
+
+	tags := make([]string, 0)
+	stats, err := r.getPaginated(ctx, transport, tagsURL, func(body io.Reader) (int, error) {
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		if err := json.NewDecoder(body).Decode(&page); err != nil {
+			return 0, err
+		}
+		tags = append(tags, page.Tags...)
+		return len(page.Tags), nil
+	})
+	tagPages.WithLabelValues(r.Hostname()).Add(float64(stats.Pages))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Tag crawl of %v incomplete after %d pages and %d tags", repositoryName, stats.Pages, stats.Entries)
+	}
 
 	refs := make([]reference.NamedTagged, 0, len(tags))
 	for _, tag := range tags {
@@ -104,52 +202,212 @@ func (r *Registry) GetTags(repositoryName reference.Named) ([]reference.NamedTag
 	return refs, nil
 }
 
-// GetManifest returns a schema for a specific tag for a specific repository
-func (r *Registry) GetManifest(tagged reference.NamedTagged) (*schema2.Manifest, error) {
-	repository, err := r.clientFactory.GetRepository(tagged)
+// CrawlStats describes how much of a paginated endpoint was crawled
+type CrawlStats struct {
+	Pages   int
+	Entries int
+}
+
+// getPaginated fetches every page of a paginated list endpoint, following
+// the Link header until it is exhausted. Each page body is passed to
+// decodePage, which returns the number of entries on the page.
+func (r *Registry) getPaginated(ctx context.Context, transport http.RoundTripper, listURL string, decodePage func(io.Reader) (int, error)) (CrawlStats, error) {
+	var stats CrawlStats
+
+	nextURL, err := url.Parse(listURL)
 	if err != nil {
-		return nil, err
+		return stats, errors.WithStack(err)
+	}
+
+	for nextURL != nil {
+		header, body, err := r.get(ctx, transport, http.MethodGet, nextURL.String())
+		if err != nil {
+			return stats, err
+		}
+
+		n, err := decodePage(bytes.NewReader(body))
+		if err != nil {
+			return stats, errors.WithStack(err)
+		}
+		stats.Pages++
+		stats.Entries += n
+
+		nextURL, err = nextPage(nextURL, header.Values("Link"))
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// nextPage resolves the next page from the Link headers of a response like
+// `</v2/_catalog?last=foo&n=100>; rel="next"`. A header may hold several
+// comma-separated links, and only the one with rel="next" is followed. It
+// returns nil on the last page.
+func nextPage(current *url.URL, links []string) (*url.URL, error) {
+	for _, link := range links {
+		rest := strings.TrimSpace(link)
+		for rest != "" {
+			end := strings.Index(rest, ">")
+			if !strings.HasPrefix(rest, "<") || end < 0 {
+				return nil, errors.Errorf("Invalid Link header %q", link)
+			}
+			target, params := rest[1:end], rest[end+1:]
+			rest = ""
+			if i := strings.Index(params, ","); i >= 0 {
+				params, rest = params[:i], strings.TrimSpace(params[i+1:])
+			}
+			if !isNextLink(params) {
+				continue
+			}
+
+			linkURL, err := url.Parse(target)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid Link header %q", link)
+			}
+			return current.ResolveReference(linkURL), nil
+		}
+	}
+	return nil, nil
+}
+
+// isNextLink reports whether the parameters of a link, like `; rel="next"`,
+// have the relation type next among their space-separated relation types
+func isNextLink(params string) bool {
+	for _, param := range strings.Split(params, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(key), "rel") {
+			continue
+		}
+		for _, rel := range strings.Fields(strings.Trim(strings.TrimSpace(value), `"`)) {
+			if strings.EqualFold(rel, "next") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// get sends a single request to the registry within the request timeout,
+// and reads the whole response body
+func (r *Registry) get(ctx context.Context, transport http.RoundTripper, method string, requestURL string, accept ...string) (http.Header, []byte, error) {
+	if r.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.requestTimeout)
+		defer cancel()
 	}
 
-	descriptor, err := repository.Tags(r.ctx).Get(r.ctx, tagged.Tag())
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, nil)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, nil, errors.WithStack(err)
+	}
+	for _, mediaType := range accept {
+		req.Header.Add("Accept", mediaType)
 	}
 
-	manifestService, err := repository.Manifests(r.ctx)
+	resp, err := (&http.Client{Transport: transport}).Do(req)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, nil, errors.WithStack(err)
 	}
+	defer resp.Body.Close()
 
-	manifestResponse, err := manifestService.Get(r.ctx, descriptor.Digest, distribution.WithManifestMediaTypes([]string{schema2.MediaTypeManifest}))
+	if !client.SuccessStatus(resp.StatusCode) {
+		return resp.Header, nil, errors.WithStack(client.HandleErrorResponse(resp))
+	}
+
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, nil, errors.WithStack(err)
+	}
+	return resp.Header, body, nil
+}
+
+// GetManifest returns the manifest for a specific tag for a specific repository,
+// along with the descriptor of the manifest
+func (r *Registry) GetManifest(ctx context.Context, tagged reference.NamedTagged) (distribution.Manifest, distribution.Descriptor, error) {
+	return r.getManifest(ctx, tagged)
+}
+
+// GetManifestByDigest returns the manifest for a specific digest for a specific repository,
+// along with the descriptor of the manifest
+func (r *Registry) GetManifestByDigest(ctx context.Context, digest reference.Canonical) (distribution.Manifest, distribution.Descriptor, error) {
+	return r.getManifest(ctx, digest)
+}
+
+// getManifest fetches a manifest by either tag or digest
+func (r *Registry) getManifest(ctx context.Context, ref reference.Named) (distribution.Manifest, distribution.Descriptor, error) {
+	transport, err := r.clientFactory.GetRepositoryTransport(ref)
+	if err != nil {
+		return nil, distribution.Descriptor{}, err
 	}
 
-	_, imageResponse, err := manifestResponse.Payload()
+	pathName, err := reference.WithName(reference.Path(ref))
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, distribution.Descriptor{}, errors.WithStack(err)
+	}
+	var manifestRef reference.Named
+	switch ref := ref.(type) {
+	case reference.Canonical:
+		manifestRef, err = reference.WithDigest(pathName, ref.Digest())
+	case reference.NamedTagged:
+		manifestRef, err = reference.WithTag(pathName, ref.Tag())
+	default:
+		err = errors.Errorf("%v has neither tag nor digest", ref)
+	}
+	if err != nil {
+		return nil, distribution.Descriptor{}, errors.WithStack(err)
 	}
 
-	var manifest schema2.Manifest
-	err = json.Unmarshal(imageResponse, &manifest)
+	manifestURL, err := r.urlBuilder.BuildManifestURL(manifestRef)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, distribution.Descriptor{}, errors.WithStack(err)
+	}
+
+	header, body, err := r.get(ctx, transport, http.MethodGet, manifestURL, ManifestMediaTypes...)
+	if err != nil {
+		return nil, distribution.Descriptor{}, err
+	}
+
+	manifest, descriptor, err := distribution.UnmarshalManifest(header.Get("Content-Type"), body)
+	if err != nil {
+		return nil, distribution.Descriptor{}, errors.Wrapf(err, "Invalid manifest for %v", ref)
+	}
+	if canonical, ok := ref.(reference.Canonical); ok && descriptor.Digest != canonical.Digest() {
+		return nil, distribution.Descriptor{}, errors.Errorf("Manifest digest mismatch for %v: got %v", ref, descriptor.Digest)
 	}
-	return &manifest, nil
+	return manifest, descriptor, nil
 }
 
 // GetImage returns a specific blob from a repository
-func (r *Registry) GetImage(digest reference.Canonical) (*types.ImageInspect, error) {
-	repository, err := r.clientFactory.GetRepository(digest)
+func (r *Registry) GetImage(ctx context.Context, digest reference.Canonical) (*types.ImageInspect, error) {
+	transport, err := r.clientFactory.GetRepositoryTransport(digest)
 	if err != nil {
 		return nil, err
 	}
 
-	imageResponse, err := repository.Blobs(r.ctx).Get(r.ctx, digest.Digest())
+	pathName, err := reference.WithName(reference.Path(digest))
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	blobRef, err := reference.WithDigest(pathName, digest.Digest())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	blobURL, err := r.urlBuilder.BuildBlobURL(blobRef)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	_, imageResponse, err := r.get(ctx, transport, http.MethodGet, blobURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := digest.Digest().Validate(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if digest.Digest().Algorithm().FromBytes(imageResponse) != digest.Digest() {
+		return nil, errors.Errorf("Blob digest mismatch for %v", digest)
+	}
 
 	var image types.ImageInspect
 	err = json.Unmarshal(imageResponse, &image)
@@ -159,17 +417,132 @@ func (r *Registry) GetImage(digest reference.Canonical) (*types.ImageInspect, er
 	return &image, nil
 }
 
-// GetImageFromTag returns a specific blob from a repository based on tag
-func (r *Registry) GetImageFromTag(tag reference.NamedTagged) (*types.ImageInspect, error) {
-	manifest, err := r.GetManifest(tag)
+// GetTagDigest returns the manifest digest a tag currently points at. This
+// only costs a HEAD request, unless the registry omits the digest header.
+func (r *Registry) GetTagDigest(ctx context.Context, tagged reference.NamedTagged) (digest.Digest, error) {
+	transport, err := r.clientFactory.GetRepositoryTransport(tagged)
+	if err != nil {
+		return "", err
+	}
+
+	pathName, err := reference.WithName(reference.Path(tagged))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	manifestRef, err := reference.WithTag(pathName, tagged.Tag())
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	manifestURL, err := r.urlBuilder.BuildManifestURL(manifestRef)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	header, _, err := r.get(ctx, transport, http.MethodHead, manifestURL, ManifestMediaTypes...)
+	if err != nil {
+		return "", err
+	}
+	if dgst, err := digest.Parse(header.Get("Docker-Content-Digest")); err == nil {
+		return dgst, nil
+	}
+
+	_, descriptor, err := r.GetManifest(ctx, tagged)
+	if err != nil {
+		return "", err
+	}
+	return descriptor.Digest, nil
+}
+
+// GetImageFromTag returns the image configs of all platforms in an image based on tag
+func (r *Registry) GetImageFromTag(ctx context.Context, tag reference.NamedTagged) (*Image, error) {
+	manifest, descriptor, err := r.GetManifest(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+	return r.resolveImage(ctx, tag, manifest, descriptor)
+}
+
+// GetImageFromDigest returns the image configs of all platforms in an image based on manifest digest
+func (r *Registry) GetImageFromDigest(ctx context.Context, dgst reference.Canonical) (*Image, error) {
+	manifest, descriptor, err := r.GetManifestByDigest(ctx, dgst)
 	if err != nil {
 		return nil, err
 	}
+	return r.resolveImage(ctx, dgst, manifest, descriptor)
+}
+
+// resolveImage resolves a manifest to the image configs of all its platforms
+func (r *Registry) resolveImage(ctx context.Context, repositoryName reference.Named, manifest distribution.Manifest, descriptor distribution.Descriptor) (*Image, error) {
+	image := &Image{
+		MediaType: descriptor.MediaType,
+		Digest:    descriptor.Digest,
+	}
+
+	switch manifest := manifest.(type) {
+	case *manifestlist.DeserializedManifestList:
+		for _, descriptor := range manifest.Manifests {
+			if descriptor.Platform.OS == "unknown" {
+				// Skip attestation manifests, as produced by buildx
+				continue
+			}
+
+			digest, err := reference.WithDigest(reference.TrimNamed(repositoryName), descriptor.Digest)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			platformManifest, platformDescriptor, err := r.GetManifestByDigest(ctx, digest)
+			if err != nil {
+				return nil, err
+			}
+			config, err := r.getImageConfig(ctx, repositoryName, platformManifest, platformDescriptor)
+			if err != nil {
+				return nil, err
+			}
+			config.OS = descriptor.Platform.OS
+			config.Architecture = descriptor.Platform.Architecture
+			config.Variant = descriptor.Platform.Variant
+			image.Configs = append(image.Configs, config)
+		}
+	default:
+		config, err := r.getImageConfig(ctx, repositoryName, manifest, descriptor)
+		if err != nil {
+			return nil, err
+		}
+		image.Configs = append(image.Configs, config)
+	}
 
-	digest, err := reference.WithDigest(tag, manifest.Config.Digest)
+	return image, nil
+}
+
+// getImageConfig fetches the image config referenced by a single-platform manifest
+func (r *Registry) getImageConfig(ctx context.Context, repositoryName reference.Named, manifest distribution.Manifest, descriptor distribution.Descriptor) (*ImageConfig, error) {
+	var configDescriptor distribution.Descriptor
+	switch manifest := manifest.(type) {
+	case *schema2.DeserializedManifest:
+		configDescriptor = manifest.Config
+	case *ocischema.DeserializedManifest:
+		configDescriptor = manifest.Config
+	default:
+		mediaType, _, _ := manifest.Payload()
+		return nil, errors.Errorf("Unsupported manifest media type %q for %v", mediaType, repositoryName)
+	}
+
+	digest, err := reference.WithDigest(reference.TrimNamed(repositoryName), configDescriptor.Digest)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	return r.GetImage(digest)
+	image, err := r.GetImage(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageConfig{
+		ManifestDigest: descriptor.Digest,
+		ConfigDigest:   configDescriptor.Digest,
+		OS:             image.Os,
+		Architecture:   image.Architecture,
+		Variant:        image.Variant,
+		Image:          image,
+	}, nil
 }